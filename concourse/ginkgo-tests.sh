@@ -2,6 +2,9 @@
 
 set -e
 
+# The dependencies are vendored with Godeps, which requires GOPATH mode.
+export GO111MODULE=off
+
 mkdir -p $GOPATH/src
 
 echo "Moving project to GOPATH..."
@@ -10,8 +13,5 @@ mkdir -p $prefix_path
 cp -r aker-proxy-plugin $prefix_path
 cd $prefix_path/aker-proxy-plugin
 
-echo "Fetching test tools..."
-go get github.com/onsi/ginkgo/ginkgo
-
 echo "Running tests..."
-ginkgo -r
+go test ./...
@@ -1,13 +1,54 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
 	"github.com/SAP/aker-proxy-plugin/proxy"
 	"github.com/SAP/aker/plugin"
 	"github.com/SAP/gologger"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+	// Aker starts plugins without arguments, so arguments select the
+	// standalone mode.
+	if len(os.Args) > 1 {
+		os.Exit(serveStandalone(os.Args[1:]))
+	}
 	if err := plugin.ListenAndServeHTTP(proxy.NewHandlerFromRawConfig); err != nil {
 		gologger.Fatalf("Error creating plugin: %v", err)
 	}
 }
+
+// validate validates the configuration file named by args, or standard
+// input for -, and prints the effective configuration. It returns the exit
+// code of the process.
+func validate(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s validate <config.yml | ->\n", filepath.Base(os.Args[0]))
+		return 2
+	}
+	var config []byte
+	var err error
+	if args[0] == "-" {
+		config, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		config, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading configuration: %v\n", err)
+		return 1
+	}
+	effective, err := proxy.ValidateRawConfig(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	os.Stdout.Write(effective)
+	return 0
+}
@@ -0,0 +1,375 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/SAP/gologger"
+)
+
+// Access log formats.
+const (
+	accessLogFormatJSON     = "json"
+	accessLogFormatCommon   = "common"
+	accessLogFormatCombined = "combined"
+	accessLogFormatLogfmt   = "logfmt"
+	accessLogFormatTemplate = "template"
+)
+
+const (
+	defaultAccessLogMaxFileBytes = 100 * 1024 * 1024
+	defaultAccessLogMaxBackups   = 3
+	commonLogTimeFormat          = "02/Jan/2006:15:04:05 -0700"
+)
+
+type accessLogConfig struct {
+	Format       string                   `yaml:"format"`
+	Template     string                   `yaml:"template"`
+	File         string                   `yaml:"file"`
+	MaxFileBytes int64                    `yaml:"max_file_bytes"`
+	MaxBackups   int                      `yaml:"max_backups"`
+	SampleRatio  *float64                 `yaml:"sample_ratio"`
+	Exclude      []accessLogExcludeConfig `yaml:"exclude"`
+}
+
+type accessLogExcludeConfig struct {
+	Path      string `yaml:"path"`
+	Method    string `yaml:"method"`
+	UserAgent string `yaml:"user_agent"`
+}
+
+// accessLogEntry holds the fields of an access log line.
+type accessLogEntry struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id"`
+	ClientAddress    string    `json:"client_address"`
+	Method           string    `json:"method"`
+	Path             string    `json:"path"`
+	Protocol         string    `json:"protocol"`
+	Upstream         string    `json:"upstream"`
+	UpstreamPath     string    `json:"upstream_path"`
+	Status           int       `json:"status"`
+	RequestBytes     int64     `json:"request_bytes"`
+	ResponseBytes    int64     `json:"response_bytes"`
+	Duration         float64   `json:"duration"`
+	UpstreamDuration float64   `json:"upstream_duration"`
+	Retries          int       `json:"retries"`
+	Referer          string    `json:"referer"`
+	UserAgent        string    `json:"user_agent"`
+}
+
+type accessLogger struct {
+	format      func(*accessLogEntry) ([]byte, error)
+	output      io.Writer
+	sampleRatio float64
+	exclude     []accessLogExcludeConfig
+}
+
+func (cfg accessLogConfig) validate(p *configProblems, path string) {
+	p.checkRatio(path+".sample_ratio", cfg.SampleRatio)
+	switch cfg.Format {
+	case accessLogFormatJSON, accessLogFormatCommon, accessLogFormatCombined, accessLogFormatLogfmt, "":
+		if cfg.Template != "" {
+			p.add(path+".template", "requires format %q", accessLogFormatTemplate)
+		}
+	case accessLogFormatTemplate:
+		if _, err := template.New("access_log").Parse(cfg.Template); err != nil {
+			p.add(path+".template", "%v", err)
+		}
+	default:
+		p.add(path+".format", "unknown access log format %q", cfg.Format)
+	}
+	if cfg.MaxFileBytes < 0 {
+		p.add(path+".max_file_bytes", "must not be negative")
+	}
+	if cfg.MaxBackups < 0 {
+		p.add(path+".max_backups", "must not be negative")
+	}
+	if cfg.File != "" {
+		p.checkWritableFile(path+".file", cfg.File)
+	}
+}
+
+func newAccessLogger(cfg accessLogConfig) (*accessLogger, error) {
+	logger := &accessLogger{
+		sampleRatio: *cfg.SampleRatio,
+		exclude:     cfg.Exclude,
+	}
+
+	switch cfg.Format {
+	case accessLogFormatJSON:
+		logger.format = formatJSONAccessLog
+	case accessLogFormatCommon:
+		logger.format = formatCommonAccessLog
+	case accessLogFormatCombined:
+		logger.format = formatCombinedAccessLog
+	case accessLogFormatLogfmt:
+		logger.format = formatLogfmtAccessLog
+	case accessLogFormatTemplate:
+		tmpl, err := template.New("access_log").Parse(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing access log template: %v", err)
+		}
+		logger.format = func(entry *accessLogEntry) ([]byte, error) {
+			var line bytes.Buffer
+			err := tmpl.Execute(&line, entry)
+			return line.Bytes(), err
+		}
+	default:
+		return nil, fmt.Errorf("unknown access log format: %q", cfg.Format)
+	}
+
+	if cfg.File == "" {
+		logger.output = gologgerWriter{}
+		return logger, nil
+	}
+	file, err := openRotatingFile(cfg.File, cfg.MaxFileBytes, cfg.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	logger.output = file
+	return logger, nil
+}
+
+// Wrap returns a handler that logs the requests served by next.
+func (l *accessLogger) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !l.shouldLog(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		start := time.Now()
+		req, info := withRequestInfo(req)
+		tw := &trackingResponseWriter{ResponseWriter: w}
+		// Deferred, so that requests whose response is aborted with
+		// http.ErrAbortHandler are logged as well.
+		defer func() {
+			l.log(&accessLogEntry{
+				Time:             start,
+				RequestID:        requestID(req),
+				ClientAddress:    clientAddress(req),
+				Method:           req.Method,
+				Path:             req.URL.RequestURI(),
+				Protocol:         req.Proto,
+				Upstream:         info.upstream,
+				UpstreamPath:     info.upstreamPath,
+				Status:           tw.Status(),
+				RequestBytes:     info.receivedBytes(),
+				ResponseBytes:    tw.bytes,
+				Duration:         time.Since(start).Seconds(),
+				UpstreamDuration: info.upstreamDuration.Seconds(),
+				Referer:          req.Referer(),
+				UserAgent:        req.UserAgent(),
+				Retries:          info.retries(),
+			})
+		}()
+		next.ServeHTTP(tw, req)
+	})
+}
+
+func (l *accessLogger) shouldLog(req *http.Request) bool {
+	for _, rule := range l.exclude {
+		if rule.matches(req) {
+			return false
+		}
+	}
+	return l.sampleRatio >= 1 || rand.Float64() < l.sampleRatio
+}
+
+func (l *accessLogger) log(entry *accessLogEntry) {
+	line, err := l.format(entry)
+	if err != nil {
+		gologger.Errorf("Error formatting access log of request %s: %v", entry.RequestID, err)
+		return
+	}
+	if _, err := l.output.Write(append(bytes.TrimRight(line, "\n"), '\n')); err != nil {
+		gologger.Errorf("Error writing access log of request %s: %v", entry.RequestID, err)
+	}
+}
+
+// matches reports whether all criteria of the rule match req.
+func (r accessLogExcludeConfig) matches(req *http.Request) bool {
+	if r.Path != "" && !matchPath(r.Path, req.URL.Path) {
+		return false
+	}
+	if r.Method != "" && !strings.EqualFold(req.Method, r.Method) {
+		return false
+	}
+	if r.UserAgent != "" && !strings.Contains(req.UserAgent(), r.UserAgent) {
+		return false
+	}
+	return r.Path != "" || r.Method != "" || r.UserAgent != ""
+}
+
+// clientAddress returns the address of the original client, which is the
+// first entry of X-Forwarded-For when the request was forwarded.
+func clientAddress(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return req.RemoteAddr
+}
+
+func formatJSONAccessLog(entry *accessLogEntry) ([]byte, error) {
+	return json.Marshal(entry)
+}
+
+func formatCommonAccessLog(entry *accessLogEntry) ([]byte, error) {
+	size := "-"
+	if entry.ResponseBytes > 0 {
+		size = strconv.FormatInt(entry.ResponseBytes, 10)
+	}
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s",
+		dashIfEmpty(entry.ClientAddress),
+		entry.Time.Format(commonLogTimeFormat),
+		entry.Method, entry.Path, entry.Protocol,
+		entry.Status, size)
+	return []byte(line), nil
+}
+
+func formatCombinedAccessLog(entry *accessLogEntry) ([]byte, error) {
+	line, _ := formatCommonAccessLog(entry)
+	line = append(line, fmt.Sprintf(" %s %s", strconv.Quote(dashIfEmpty(entry.Referer)), strconv.Quote(dashIfEmpty(entry.UserAgent)))...)
+	return line, nil
+}
+
+func formatLogfmtAccessLog(entry *accessLogEntry) ([]byte, error) {
+	fields := []struct {
+		key   string
+		value string
+	}{
+		{"time", entry.Time.Format(time.RFC3339Nano)},
+		{"request_id", entry.RequestID},
+		{"client_address", entry.ClientAddress},
+		{"method", entry.Method},
+		{"path", entry.Path},
+		{"protocol", entry.Protocol},
+		{"upstream", entry.Upstream},
+		{"upstream_path", entry.UpstreamPath},
+		{"status", strconv.Itoa(entry.Status)},
+		{"request_bytes", strconv.FormatInt(entry.RequestBytes, 10)},
+		{"response_bytes", strconv.FormatInt(entry.ResponseBytes, 10)},
+		{"duration", strconv.FormatFloat(entry.Duration, 'f', -1, 64)},
+		{"upstream_duration", strconv.FormatFloat(entry.UpstreamDuration, 'f', -1, 64)},
+		{"retries", strconv.Itoa(entry.Retries)},
+		{"referer", entry.Referer},
+		{"user_agent", entry.UserAgent},
+	}
+	var line bytes.Buffer
+	for i, field := range fields {
+		if i > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(field.key)
+		line.WriteByte('=')
+		if field.value == "" || strings.ContainsAny(field.value, " =\"\t\n") {
+			line.WriteString(strconv.Quote(field.value))
+		} else {
+			line.WriteString(field.value)
+		}
+	}
+	return line.Bytes(), nil
+}
+
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// gologgerWriter writes each line as an info message of gologger.
+type gologgerWriter struct{}
+
+func (gologgerWriter) Write(data []byte) (int, error) {
+	gologger.Infof("%s", strings.TrimSuffix(string(data), "\n"))
+	return len(data), nil
+}
+
+// rotatingFile is a file that is rotated once it exceeds maxBytes. Rotated
+// files get the suffixes .1 to .maxBackups, with .1 being the most recent.
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+	mutex      sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) Write(data []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.size > 0 && f.size+int64(len(data)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate moves the file to the first backup and opens a new file. The
+// current file stays open until the new one is, so that the next write
+// tries again if rotating fails. The file is not moved if it is missing,
+// as it is when opening the new file failed before.
+func (f *rotatingFile) rotate() error {
+	if _, err := os.Stat(f.path); err == nil {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	}
+	previous := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	return previous.Close()
+}
@@ -0,0 +1,286 @@
+package proxy_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Access log", func() {
+	var fakeServer *ghttp.Server
+	var logDir string
+	var logFile string
+	var accessLogConfig string
+	var request *http.Request
+	var handler http.Handler
+
+	logLines := func() []string {
+		content, err := ioutil.ReadFile(logFile)
+		Ω(err).ShouldNot(HaveOccurred())
+		return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+
+	BeforeEach(func() {
+		fakeServer = ghttp.NewServer()
+		fakeServer.AllowUnhandledRequests = true
+		fakeServer.UnhandledRequestStatusCode = http.StatusOK
+		fakeServer.RouteToHandler("GET", "/base/path", ghttp.RespondWith(http.StatusCreated, "content"))
+
+		var err error
+		logDir, err = ioutil.TempDir("", "accesslog")
+		Ω(err).ShouldNot(HaveOccurred())
+		logFile = filepath.Join(logDir, "access.log")
+		accessLogConfig = ""
+
+		request, err = http.NewRequest("GET", "http://example.com/proxy/path?q=1", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		request.RemoteAddr = "10.0.0.2:1234"
+		request.Header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+		request.Header.Set("X-Aker-Request-Id", "some-request-id")
+		request.Header.Set("User-Agent", "test-agent")
+	})
+
+	AfterEach(func() {
+		fakeServer.Close()
+		os.RemoveAll(logDir)
+	})
+
+	JustBeforeEach(func() {
+		config := "url: " + fakeServer.URL() + "/base\nproxy_path: /proxy\naccess_log:\n  file: " + logFile + "\n" + accessLogConfig
+		var err error
+		handler, err = NewHandlerFromRawConfig([]byte(config))
+		Ω(err).ShouldNot(HaveOccurred())
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	})
+
+	Context("when using the default format", func() {
+		It("should log the request as JSON", func() {
+			lines := logLines()
+			Ω(lines).Should(HaveLen(1))
+
+			var entry map[string]interface{}
+			Ω(json.Unmarshal([]byte(lines[0]), &entry)).Should(Succeed())
+			Ω(entry).Should(HaveKeyWithValue("request_id", "some-request-id"))
+			Ω(entry).Should(HaveKeyWithValue("client_address", "10.0.0.1"))
+			Ω(entry).Should(HaveKeyWithValue("path", "/proxy/path?q=1"))
+			Ω(entry).Should(HaveKeyWithValue("upstream", fakeServer.URL()))
+			Ω(entry).Should(HaveKeyWithValue("upstream_path", "/base/path?q=1"))
+			Ω(entry).Should(HaveKeyWithValue("status", BeNumerically("==", http.StatusCreated)))
+			Ω(entry).Should(HaveKeyWithValue("response_bytes", BeNumerically("==", 7)))
+			Ω(entry).Should(HaveKey("duration"))
+			Ω(entry).Should(HaveKey("upstream_duration"))
+			Ω(entry).Should(HaveKeyWithValue("retries", BeNumerically("==", 0)))
+		})
+	})
+
+	Context("when using the combined log format", func() {
+		BeforeEach(func() {
+			accessLogConfig = "  format: combined\n"
+		})
+
+		It("should log the request in combined log format", func() {
+			Ω(logLines()[0]).Should(MatchRegexp(`^10\.0\.0\.1 - - \[[^\]]+\] "GET /proxy/path\?q=1 HTTP/1\.1" 201 7 "-" "test-agent"$`))
+		})
+	})
+
+	Context("when using the logfmt format", func() {
+		BeforeEach(func() {
+			accessLogConfig = "  format: logfmt\n"
+		})
+
+		It("should log the request as key value pairs", func() {
+			line := logLines()[0]
+			Ω(line).Should(ContainSubstring(" request_id=some-request-id "))
+			Ω(line).Should(ContainSubstring(" status=201 "))
+			Ω(line).Should(ContainSubstring(` referer="" `))
+		})
+	})
+
+	Context("when using a template", func() {
+		BeforeEach(func() {
+			accessLogConfig = "  format: template\n  template: '{{.Method}} {{.UpstreamPath}} {{.Status}}'\n"
+		})
+
+		It("should log the request using the template", func() {
+			Ω(logLines()).Should(Equal([]string{"GET /base/path?q=1 201"}))
+		})
+	})
+
+	Context("when the request matches an exclusion rule", func() {
+		BeforeEach(func() {
+			accessLogConfig = "  exclude:\n  - path: /proxy/*\n    method: GET\n"
+		})
+
+		It("should not log the request", func() {
+			Ω(logLines()).Should(Equal([]string{""}))
+		})
+	})
+
+	Context("when the sample ratio is zero", func() {
+		BeforeEach(func() {
+			accessLogConfig = "  sample_ratio: 0\n"
+		})
+
+		It("should not log the request", func() {
+			Ω(logLines()).Should(Equal([]string{""}))
+		})
+	})
+
+	Context("when the log file exceeds its maximum size", func() {
+		BeforeEach(func() {
+			accessLogConfig = "  max_file_bytes: 10\n"
+			Ω(ioutil.WriteFile(logFile, []byte("previous\n"), 0644)).Should(Succeed())
+		})
+
+		It("should rotate the log file", func() {
+			previous, err := ioutil.ReadFile(logFile + ".1")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(previous)).Should(Equal("previous\n"))
+			Ω(logLines()).Should(HaveLen(1))
+			Ω(logLines()[0]).Should(ContainSubstring("some-request-id"))
+		})
+
+		Context("and the rotation fails", func() {
+			BeforeEach(func() {
+				accessLogConfig += "  max_backups: 1\n"
+				Ω(os.Mkdir(logFile+".1", 0755)).Should(Succeed())
+				Ω(ioutil.WriteFile(filepath.Join(logFile+".1", "blocking"), nil, 0644)).Should(Succeed())
+			})
+
+			It("should keep logging once the rotation succeeds", func() {
+				Ω(logLines()).Should(Equal([]string{"previous"}))
+
+				Ω(os.RemoveAll(logFile + ".1")).Should(Succeed())
+				handler.ServeHTTP(httptest.NewRecorder(), request)
+				previous, err := ioutil.ReadFile(logFile + ".1")
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(previous)).Should(Equal("previous\n"))
+				Ω(logLines()).Should(HaveLen(1))
+				Ω(logLines()[0]).Should(ContainSubstring("some-request-id"))
+			})
+		})
+	})
+})
+
+var _ = Describe("Access log of streamed requests", func() {
+	var logDir string
+	var logFile string
+
+	logEntries := func() []map[string]interface{} {
+		content, err := ioutil.ReadFile(logFile)
+		Ω(err).ShouldNot(HaveOccurred())
+		var entries []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			var entry map[string]interface{}
+			Ω(json.Unmarshal([]byte(line), &entry)).Should(Succeed())
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	get := func(upstream, config string) {
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream + "\naccess_log:\n  file: " + logFile + "\n" + config))
+		Ω(err).ShouldNot(HaveOccurred())
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		resp, err := http.Get(server.URL + "/path")
+		Ω(err).ShouldNot(HaveOccurred())
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	BeforeEach(func() {
+		var err error
+		logDir, err = ioutil.TempDir("", "accesslog")
+		Ω(err).ShouldNot(HaveOccurred())
+		logFile = filepath.Join(logDir, "access.log")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(logDir)
+	})
+
+	It("should log requests whose response is aborted", func() {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("12345678"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("12345678"))
+		}))
+		defer upstream.Close()
+		get(upstream.URL, "max_response_body_bytes: 10\n")
+
+		Eventually(func() []byte {
+			content, _ := ioutil.ReadFile(logFile)
+			return content
+		}).ShouldNot(BeEmpty())
+		Ω(logEntries()[0]).Should(HaveKeyWithValue("status", BeNumerically("==", http.StatusOK)))
+	})
+
+	It("should log how often the request was retried", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			// The first connection serves one request and is closed when
+			// reused, so that the second request is retried.
+			for first := true; ; first = false {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				reader := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(reader); err == nil {
+					conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+				}
+				if first {
+					http.ReadRequest(reader)
+				}
+				conn.Close()
+			}
+		}()
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://" + listener.Addr().String() + "\naccess_log:\n  file: " + logFile + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		for i := 0; i < 2; i++ {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/path", nil))
+			Ω(recorder.Code).Should(Equal(http.StatusOK))
+		}
+
+		entries := logEntries()
+		Ω(entries).Should(HaveLen(2))
+		Ω(entries[0]).Should(HaveKeyWithValue("retries", BeNumerically("==", 0)))
+		Ω(entries[1]).Should(HaveKeyWithValue("retries", BeNumerically("==", 1)))
+	})
+})
+
+var _ = Describe("Access log configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost\naccess_log:\n" + config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail on unknown format", func() {
+		itShouldFail("  format: apache\n")
+	})
+
+	It("should fail on invalid template", func() {
+		itShouldFail("  format: template\n  template: '{{.Method'\n")
+	})
+
+	It("should fail on invalid sample ratio", func() {
+		itShouldFail("  sample_ratio: -1\n")
+	})
+})
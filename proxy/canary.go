@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// canaryBuckets is the number of buckets requests are hashed into, which
+// allows weights with a precision of 0.01 percent.
+const canaryBuckets = 10000
+
+type canaryConfig struct {
+	URL    string             `yaml:"url"`
+	Weight float64            `yaml:"weight"`
+	Sticky canaryStickyConfig `yaml:"sticky"`
+}
+
+type canaryStickyConfig struct {
+	Cookie   string `yaml:"cookie"`
+	Header   string `yaml:"header"`
+	ClientIP bool   `yaml:"client_ip"`
+}
+
+type canaryKey struct{}
+
+// canary forwards a share of the requests to a canary target. Requests
+// carrying the configured sticky key are assigned by its hash, so they keep
+// going to the same target. As the hash does not depend on the weight,
+// increasing the weight only moves requests from the primary target to the
+// canary and never back.
+type canary struct {
+	target    *url.URL
+	threshold uint32
+	cookie    string
+	header    string
+	clientIP  bool
+}
+
+func (cfg canaryConfig) validate(p *configProblems, path string) {
+	if cfg.URL == "" {
+		p.add(path+".url", "must not be empty")
+	} else {
+		p.checkUpstreamURL(path+".url", cfg.URL)
+	}
+	if cfg.Weight < 0 || cfg.Weight > 100 {
+		p.add(path+".weight", "must be between 0 and 100")
+	}
+	if countSet(cfg.Sticky.Cookie != "", cfg.Sticky.Header != "", cfg.Sticky.ClientIP) > 1 {
+		p.add(path+".sticky", "must set at most one of cookie, header or client_ip")
+	}
+}
+
+func newCanary(cfg *canaryConfig) (*canary, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	target, err := parseTargetURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid canary: %v", err)
+	}
+	return &canary{
+		target:    target,
+		threshold: uint32(cfg.Weight*canaryBuckets/100 + 0.5),
+		cookie:    cfg.Sticky.Cookie,
+		header:    cfg.Sticky.Header,
+		clientIP:  cfg.Sticky.ClientIP,
+	}, nil
+}
+
+// selects reports whether req is to be forwarded to the canary.
+func (c *canary) selects(req *http.Request) bool {
+	if c.threshold == 0 {
+		return false
+	}
+	if c.threshold >= canaryBuckets {
+		return true
+	}
+	key, ok := c.stickyKey(req)
+	if !ok {
+		return uint32(rand.Intn(canaryBuckets)) < c.threshold
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32()%canaryBuckets < c.threshold
+}
+
+func (c *canary) stickyKey(req *http.Request) (string, bool) {
+	switch {
+	case c.cookie != "":
+		if cookie, err := req.Cookie(c.cookie); err == nil && cookie.Value != "" {
+			return cookie.Value, true
+		}
+	case c.header != "":
+		if value := req.Header.Get(c.header); value != "" {
+			return value, true
+		}
+	case c.clientIP:
+		address := clientAddress(req)
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+		return address, address != ""
+	}
+	return "", false
+}
+
+// splitTraffic returns a handler that decides for each request whether it
+// goes to the canary of its route or, without a route, to defaultCanary.
+func splitTraffic(next http.Handler, defaultCanary *canary) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c := defaultCanary
+		if route := routeOf(req); route != nil {
+			c = route.canary
+		}
+		if c != nil && c.selects(req) {
+			req = req.WithContext(context.WithValue(req.Context(), canaryKey{}, c.target))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// canaryTargetOf returns the canary target chosen for req or nil if the
+// request goes to its primary target.
+func canaryTargetOf(req *http.Request) *url.URL {
+	target, _ := req.Context().Value(canaryKey{}).(*url.URL)
+	return target
+}
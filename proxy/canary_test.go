@@ -0,0 +1,130 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Canary", func() {
+	var primaryServer *ghttp.Server
+	var canaryServer *ghttp.Server
+	var canaryConfig string
+	var handler http.Handler
+
+	newRequest := func(userID string) *http.Request {
+		request, err := http.NewRequest("GET", "http://example.com/path", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		request.Header.Set("X-Aker-User-Id", userID)
+		return request
+	}
+
+	serve := func(request *http.Request) int {
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	BeforeEach(func() {
+		primaryServer = ghttp.NewServer()
+		primaryServer.AllowUnhandledRequests = true
+		primaryServer.UnhandledRequestStatusCode = http.StatusOK
+		canaryServer = ghttp.NewServer()
+		canaryServer.AllowUnhandledRequests = true
+		canaryServer.UnhandledRequestStatusCode = http.StatusAccepted
+	})
+
+	AfterEach(func() {
+		primaryServer.Close()
+		canaryServer.Close()
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		handler, err = NewHandlerFromRawConfig([]byte("url: " + primaryServer.URL() + "\n" + canaryConfig))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	Context("when the canary is sticky by header", func() {
+		BeforeEach(func() {
+			canaryConfig = "canary:\n  url: " + canaryServer.URL() + "\n  weight: 30\n  sticky:\n    header: X-Aker-User-Id\n"
+		})
+
+		It("should split the traffic by weight", func() {
+			canaryRequests := 0
+			for i := 0; i < 1000; i++ {
+				if serve(newRequest(fmt.Sprintf("user-%d", i))) == http.StatusAccepted {
+					canaryRequests++
+				}
+			}
+			Ω(canaryRequests).Should(BeNumerically("~", 300, 60))
+		})
+
+		It("should keep users on the same target", func() {
+			for i := 0; i < 20; i++ {
+				first := serve(newRequest(fmt.Sprintf("user-%d", i)))
+				for j := 0; j < 5; j++ {
+					Ω(serve(newRequest(fmt.Sprintf("user-%d", i)))).Should(Equal(first))
+				}
+			}
+		})
+
+		It("should not forward the sticky header", func() {
+			serve(newRequest("user-1"))
+			requests := append(primaryServer.ReceivedRequests(), canaryServer.ReceivedRequests()...)
+			Ω(requests).Should(HaveLen(1))
+			Ω(requests[0].Header.Get("X-Aker-User-Id")).Should(BeEmpty())
+		})
+	})
+
+	Context("when the canary has full weight", func() {
+		BeforeEach(func() {
+			canaryConfig = "canary:\n  url: " + canaryServer.URL() + "\n  weight: 100\n  sticky:\n    client_ip: true\n"
+		})
+
+		It("should forward all requests to the canary", func() {
+			Ω(serve(newRequest("user-1"))).Should(Equal(http.StatusAccepted))
+			Ω(primaryServer.ReceivedRequests()).Should(BeEmpty())
+		})
+	})
+
+	Context("when the canary belongs to a route", func() {
+		BeforeEach(func() {
+			canaryConfig = "routes:\n- path: /other\n  url: " + primaryServer.URL() + "\n  canary:\n    url: " + canaryServer.URL() + "\n    weight: 100\n"
+		})
+
+		It("should only apply to requests of the route", func() {
+			Ω(serve(newRequest("user-1"))).Should(Equal(http.StatusOK))
+
+			request := newRequest("user-1")
+			request.URL.Path = "/other"
+			Ω(serve(request)).Should(Equal(http.StatusAccepted))
+		})
+	})
+})
+
+var _ = Describe("Canary configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost\ncanary:\n" + config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail on invalid weight", func() {
+		itShouldFail("  url: http://canary\n  weight: 101\n")
+	})
+
+	It("should fail on several sticky keys", func() {
+		itShouldFail("  url: http://canary\n  weight: 10\n  sticky:\n    cookie: user\n    client_ip: true\n")
+	})
+
+	It("should fail without url", func() {
+		itShouldFail("  weight: 10\n")
+	})
+})
@@ -0,0 +1,389 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const defaultCompressionMinSize = 1024
+
+var defaultCompressionAlgorithms = []string{"br", "gzip", "deflate"}
+
+var defaultCompressibleContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+type compressionConfig struct {
+	Algorithms   []string `yaml:"algorithms"`
+	ContentTypes []string `yaml:"content_types"`
+	MinSize      int64    `yaml:"min_size"`
+	Decompress   bool     `yaml:"decompress"`
+}
+
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var encoders = map[string]func(io.Writer) compressWriter{
+	"gzip": func(w io.Writer) compressWriter {
+		return gzip.NewWriter(w)
+	},
+	"deflate": func(w io.Writer) compressWriter {
+		return zlib.NewWriter(w)
+	},
+	"br": func(w io.Writer) compressWriter {
+		return brotli.NewWriter(w)
+	},
+}
+
+var decoders = map[string]func(io.Reader) (io.ReadCloser, error){
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"x-gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": newDeflateReader,
+	"br": func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	},
+}
+
+// newDeflateReader accepts both the zlib wrapped format mandated by the
+// HTTP specification and the raw deflate stream some servers send instead.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+type compressor struct {
+	algorithms   []string
+	contentTypes []string
+	minSize      int64
+	decompress   bool
+}
+
+func (cfg compressionConfig) validate(p *configProblems, path string) {
+	for i, algorithm := range cfg.Algorithms {
+		if _, ok := encoders[strings.ToLower(algorithm)]; !ok {
+			p.add(fmt.Sprintf("%s.algorithms[%d]", path, i), "unsupported compression algorithm %q", algorithm)
+		}
+	}
+	if cfg.MinSize < 0 {
+		p.add(path+".min_size", "must not be negative")
+	}
+}
+
+func newCompressor(cfg compressionConfig) (*compressor, error) {
+	c := &compressor{
+		algorithms:   make([]string, len(cfg.Algorithms)),
+		contentTypes: cfg.ContentTypes,
+		minSize:      cfg.MinSize,
+		decompress:   cfg.Decompress,
+	}
+	for i, algorithm := range cfg.Algorithms {
+		c.algorithms[i] = strings.ToLower(algorithm)
+	}
+	return c, nil
+}
+
+// Wrap returns a handler that compresses the responses of next according to
+// the Accept-Encoding header of the request.
+func (c *compressor) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			compressor:     c,
+			encoding:       negotiateEncoding(req.Header.Get("Accept-Encoding"), c.algorithms),
+			head:           req.Method == "HEAD",
+		}
+		defer cw.close()
+		next.ServeHTTP(cw, req)
+	})
+}
+
+// DecompressResponse decodes upstream responses whose content coding is not
+// accepted by the client. It is meant to be used as ModifyResponse of the
+// reverse proxy.
+func (c *compressor) DecompressResponse(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return nil
+	}
+	newDecoder, ok := decoders[encoding]
+	if !ok || acceptsEncoding(resp.Request.Header.Get("Accept-Encoding"), encoding) {
+		return nil
+	}
+	if resp.Request.Method == "HEAD" || !bodyAllowedForStatus(resp.StatusCode) {
+		return nil
+	}
+
+	decoder, err := newDecoder(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error decoding %s response: %v", encoding, err)
+	}
+	resp.Body = &decodedBody{
+		ReadCloser: decoder,
+		original:   resp.Body,
+	}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	weakenETag(resp.Header)
+	addVary(resp.Header, "Accept-Encoding")
+	return nil
+}
+
+func (c *compressor) compressible(header http.Header) bool {
+	encoding := strings.TrimSpace(header.Get("Content-Encoding"))
+	if encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+	if strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	return matchesContentType(header.Get("Content-Type"), c.contentTypes)
+}
+
+type decodedBody struct {
+	io.ReadCloser
+	original io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.original.Close()
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	compressor *compressor
+	encoding   string
+	head       bool
+
+	status      int
+	wroteHeader bool
+	pending     bool
+	buffer      []byte
+	writer      compressWriter
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	header := w.Header()
+	if !w.compressor.compressible(header) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	addVary(header, "Accept-Encoding")
+	if w.encoding == "" || w.head || status == http.StatusPartialContent || !bodyAllowedForStatus(status) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if contentLength, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		if contentLength < w.compressor.minSize {
+			w.ResponseWriter.WriteHeader(status)
+		} else {
+			w.startCompression()
+		}
+		return
+	}
+	w.pending = true
+}
+
+func (w *compressResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case w.writer != nil:
+		return w.writer.Write(data)
+	case w.pending:
+		w.buffer = append(w.buffer, data...)
+		if int64(len(w.buffer)) >= w.compressor.minSize {
+			if err := w.startCompression(); err != nil {
+				return 0, err
+			}
+		}
+		return len(data), nil
+	default:
+		return w.ResponseWriter.Write(data)
+	}
+}
+
+// Flush starts compression of pending responses, as a flush indicates a
+// streaming response whose size can not be known in advance.
+func (w *compressResponseWriter) Flush() {
+	if w.pending {
+		w.startCompression()
+	}
+	if w.writer != nil {
+		w.writer.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressResponseWriter) startCompression() error {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", w.encoding)
+	weakenETag(header)
+	w.ResponseWriter.WriteHeader(w.status)
+
+	w.pending = false
+	w.writer = encoders[w.encoding](w.ResponseWriter)
+	buffer := w.buffer
+	w.buffer = nil
+	_, err := w.writer.Write(buffer)
+	return err
+}
+
+func (w *compressResponseWriter) close() error {
+	if w.pending {
+		w.pending = false
+		w.ResponseWriter.WriteHeader(w.status)
+		_, err := w.ResponseWriter.Write(w.buffer)
+		return err
+	}
+	if w.writer != nil {
+		return w.writer.Close()
+	}
+	return nil
+}
+
+// negotiateEncoding returns the supported content coding with the highest
+// quality value in acceptEncoding. Ties are resolved in favour of the coding
+// that comes first in supported. An empty string is returned when none of the
+// supported codings is acceptable.
+func negotiateEncoding(acceptEncoding string, supported []string) string {
+	best := ""
+	bestQuality := 0.0
+	for _, encoding := range supported {
+		if quality := encodingQuality(acceptEncoding, encoding); quality > bestQuality {
+			best = encoding
+			bestQuality = quality
+		}
+	}
+	return best
+}
+
+func acceptsEncoding(acceptEncoding, encoding string) bool {
+	return encodingQuality(acceptEncoding, encoding) > 0
+}
+
+func encodingQuality(acceptEncoding, encoding string) float64 {
+	wildcard := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, quality := parseQuality(part)
+		switch {
+		case strings.EqualFold(coding, encoding):
+			return quality
+		case coding == "*":
+			wildcard = quality
+		}
+	}
+	return wildcard
+}
+
+func parseQuality(part string) (string, float64) {
+	fields := strings.Split(part, ";")
+	value := strings.TrimSpace(fields[0])
+	quality := 1.0
+	for _, param := range fields[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(strings.ToLower(param), "q=") {
+			continue
+		}
+		if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+			quality = q
+		}
+	}
+	return value, quality
+}
+
+func matchesContentType(contentType string, patterns []string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*/*" || pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status < 200:
+		return false
+	case status == http.StatusNoContent || status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// weakenETag converts a strong entity tag into a weak one, since the
+// transformed representation is no longer byte-for-byte identical to the
+// one the upstream tagged.
+func weakenETag(header http.Header) {
+	etag := header.Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+func addVary(header http.Header, name string) {
+	for _, value := range header["Vary"] {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
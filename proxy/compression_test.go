@@ -0,0 +1,169 @@
+package proxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	"github.com/andybalholm/brotli"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Compression", func() {
+	var largePayload = strings.Repeat("compressible content ", 100)
+
+	var fakeServer *ghttp.Server
+	var config string
+	var handler http.Handler
+	var request *http.Request
+	var response *httptest.ResponseRecorder
+
+	gunzip := func(data []byte) string {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		Ω(err).ShouldNot(HaveOccurred())
+		content, err := ioutil.ReadAll(reader)
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(content)
+	}
+
+	BeforeEach(func() {
+		fakeServer = ghttp.NewServer()
+		response = httptest.NewRecorder()
+		var err error
+		request, err = http.NewRequest("GET", "http://example.com/resource", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		config = "url: " + fakeServer.URL() + "\ncompression:\n  decompress: true\n"
+	})
+
+	AfterEach(func() {
+		fakeServer.Close()
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		handler, err = NewHandlerFromRawConfig([]byte(config))
+		Ω(err).ShouldNot(HaveOccurred())
+		handler.ServeHTTP(response, request)
+	})
+
+	Context("when the client accepts gzip", func() {
+		BeforeEach(func() {
+			request.Header.Set("Accept-Encoding", "gzip")
+		})
+
+		Context("and the response is large and compressible", func() {
+			BeforeEach(func() {
+				fakeServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, largePayload, http.Header{
+					"Content-Type": []string{"application/json"},
+					"ETag":         []string{`"abc"`},
+				}))
+			})
+
+			It("should compress the response", func() {
+				Ω(response.Code).Should(Equal(http.StatusOK))
+				Ω(response.Header().Get("Content-Encoding")).Should(Equal("gzip"))
+				Ω(response.Header().Get("Content-Length")).Should(BeEmpty())
+				Ω(gunzip(response.Body.Bytes())).Should(Equal(largePayload))
+			})
+
+			It("should set Vary and weaken the ETag", func() {
+				Ω(response.Header().Get("Vary")).Should(Equal("Accept-Encoding"))
+				Ω(response.Header().Get("ETag")).Should(Equal(`W/"abc"`))
+			})
+		})
+
+		Context("and the response is below the minimum size", func() {
+			BeforeEach(func() {
+				fakeServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, "small", http.Header{
+					"Content-Type": []string{"text/plain"},
+				}))
+			})
+
+			It("should not compress the response", func() {
+				Ω(response.Header().Get("Content-Encoding")).Should(BeEmpty())
+				Ω(response.Header().Get("Vary")).Should(Equal("Accept-Encoding"))
+				Ω(response.Body.String()).Should(Equal("small"))
+			})
+		})
+
+		Context("and the content type is not allowed", func() {
+			BeforeEach(func() {
+				fakeServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, largePayload, http.Header{
+					"Content-Type": []string{"image/png"},
+				}))
+			})
+
+			It("should not compress the response", func() {
+				Ω(response.Header().Get("Content-Encoding")).Should(BeEmpty())
+				Ω(response.Header().Get("Vary")).Should(BeEmpty())
+				Ω(response.Body.String()).Should(Equal(largePayload))
+			})
+		})
+	})
+
+	Context("when the client prefers brotli", func() {
+		BeforeEach(func() {
+			request.Header.Set("Accept-Encoding", "gzip;q=0.5, br")
+			fakeServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, largePayload, http.Header{
+				"Content-Type": []string{"text/html; charset=utf-8"},
+			}))
+		})
+
+		It("should compress the response with brotli", func() {
+			Ω(response.Header().Get("Content-Encoding")).Should(Equal("br"))
+			content, err := ioutil.ReadAll(brotli.NewReader(response.Body))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(content)).Should(Equal(largePayload))
+		})
+	})
+
+	Context("when the upstream response is compressed", func() {
+		BeforeEach(func() {
+			var compressed bytes.Buffer
+			writer := gzip.NewWriter(&compressed)
+			writer.Write([]byte(largePayload))
+			writer.Close()
+			fakeServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, compressed.Bytes(), http.Header{
+				"Content-Type":     []string{"text/plain"},
+				"Content-Encoding": []string{"gzip"},
+			}))
+		})
+
+		Context("and the client does not accept the encoding", func() {
+			BeforeEach(func() {
+				request.Header.Set("Accept-Encoding", "identity")
+			})
+
+			It("should decompress the response", func() {
+				Ω(response.Header().Get("Content-Encoding")).Should(BeEmpty())
+				Ω(response.Body.String()).Should(Equal(largePayload))
+			})
+		})
+
+		Context("and the client accepts the encoding", func() {
+			BeforeEach(func() {
+				request.Header.Set("Accept-Encoding", "gzip")
+			})
+
+			It("should pass the response through", func() {
+				Ω(response.Header().Get("Content-Encoding")).Should(Equal("gzip"))
+				Ω(gunzip(response.Body.Bytes())).Should(Equal(largePayload))
+			})
+		})
+	})
+})
+
+var _ = Describe("Compression configuration", func() {
+	It("should fail on unsupported algorithm", func() {
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost\ncompression:\n  algorithms: [lzma]\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	})
+})
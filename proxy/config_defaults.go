@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/SAP/aker/plugin"
+	"gopkg.in/yaml.v2"
+)
+
+// ValidateRawConfig validates config like NewHandlerFromRawConfig and
+// returns the effective configuration with defaults filled in. If config
+// refers to a config_file, the configuration of the file is validated and
+// returned instead. Values that are set by references keep the references,
+// so that resolved secret values are not revealed. Validation has no side
+// effects: files are only read, and no listeners, log files, DNS queries or
+// span exporters are started.
+func ValidateRawConfig(config []byte) ([]byte, error) {
+	cfg, err := unmarshalHandlerConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ConfigFile != nil {
+		fileCfg, err := checkConfigFile(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if config, err = ioutil.ReadFile(fileCfg.Path); err != nil {
+			return nil, err
+		}
+		if cfg, err = unmarshalConfigFile(config); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %v", fileCfg.Path, err)
+		}
+	}
+
+	if err := checkReadFiles(cfg); err != nil {
+		return nil, cfg.secrets.redact(err)
+	}
+	effective := withDefaults(cfg)
+	if bytes.Contains(config, []byte(referenceStart)) {
+		var document interface{}
+		if err := yaml.Unmarshal(config, &document); err != nil {
+			return nil, err
+		}
+		restoreReferences(reflect.ValueOf(&effective), document)
+	}
+	return plugin.MarshalConfig(effective)
+}
+
+// checkReadFiles reads the files the handler reads its targets and
+// intercepted responses from, so that their problems are reported as well.
+func checkReadFiles(cfg handlerConfig) error {
+	if cfg.TargetsFile != nil {
+		targets, _, err := readTargetsFile(cfg.TargetsFile.Path)
+		if err != nil {
+			return err
+		}
+		if _, err := parsePoolTargets(targets); err != nil {
+			return fmt.Errorf("invalid targets file %s: %v", cfg.TargetsFile.Path, err)
+		}
+	}
+	_, err := newInterceptRules(cfg.InterceptErrors)
+	return err
+}
+
+// withDefaults returns a copy of cfg with the defaults of the handler
+// filled in for the properties that are not set. It is the only place the
+// defaults are defined, as newHandler builds the handler from its result.
+// Error templates are left out, as the built-in templates are not meant to
+// be edited.
+func withDefaults(cfg handlerConfig) handlerConfig {
+	if cfg.MinUploadRate > 0 && cfg.UploadGracePeriod == 0 {
+		cfg.UploadGracePeriod = defaultUploadGracePeriod
+	}
+	if cfg.Compression != nil {
+		compression := *cfg.Compression
+		if len(compression.Algorithms) == 0 {
+			compression.Algorithms = defaultCompressionAlgorithms
+		}
+		if len(compression.ContentTypes) == 0 {
+			compression.ContentTypes = defaultCompressibleContentTypes
+		}
+		if compression.MinSize == 0 {
+			compression.MinSize = defaultCompressionMinSize
+		}
+		cfg.Compression = &compression
+	}
+	if cfg.ErrorResponses != nil {
+		errorResponses := *cfg.ErrorResponses
+		errorResponses.Statuses = make(map[string]int)
+		for class, status := range defaultErrorStatuses {
+			errorResponses.Statuses[class] = status
+		}
+		for class, status := range cfg.ErrorResponses.Statuses {
+			errorResponses.Statuses[class] = status
+		}
+		if len(errorResponses.Formats) == 0 {
+			errorResponses.Formats = defaultErrorFormats
+		}
+		cfg.ErrorResponses = &errorResponses
+	}
+	if len(cfg.InterceptErrors) > 0 {
+		rules := make([]interceptRuleConfig, len(cfg.InterceptErrors))
+		for i, rule := range cfg.InterceptErrors {
+			rule.ContentType = rule.contentType()
+			rules[i] = rule
+		}
+		cfg.InterceptErrors = rules
+	}
+	if cfg.Metrics != nil {
+		metrics := *cfg.Metrics
+		if metrics.Path == "" {
+			metrics.Path = defaultMetricsPath
+		}
+		cfg.Metrics = &metrics
+	}
+	if cfg.Tracing != nil {
+		tracing := *cfg.Tracing
+		if tracing.ServiceName == "" {
+			tracing.ServiceName = defaultTracingServiceName
+		}
+		if tracing.SampleRatio == nil {
+			tracing.SampleRatio = float64Ptr(1)
+		}
+		if len(tracing.Propagators) == 0 {
+			tracing.Propagators = []string{propagatorTraceContext, propagatorB3}
+		}
+		if tracing.BatchTimeout == 0 {
+			tracing.BatchTimeout = defaultTracingBatchTimeout
+		}
+		if tracing.BatchSize == 0 {
+			tracing.BatchSize = defaultTracingBatchSize
+		}
+		cfg.Tracing = &tracing
+	}
+	if cfg.AccessLog != nil {
+		accessLog := *cfg.AccessLog
+		if accessLog.Format == "" {
+			accessLog.Format = accessLogFormatJSON
+		}
+		if accessLog.SampleRatio == nil {
+			accessLog.SampleRatio = float64Ptr(1)
+		}
+		if accessLog.File != "" && accessLog.MaxFileBytes == 0 {
+			accessLog.MaxFileBytes = defaultAccessLogMaxFileBytes
+		}
+		if accessLog.File != "" && accessLog.MaxBackups == 0 {
+			accessLog.MaxBackups = defaultAccessLogMaxBackups
+		}
+		cfg.AccessLog = &accessLog
+	}
+	if cfg.DebugCapture != nil {
+		capture := *cfg.DebugCapture
+		if capture.MaxBodyBytes == 0 {
+			capture.MaxBodyBytes = defaultCaptureMaxBodyBytes
+		}
+		capture.RedactHeaders = withDefaultRedactedHeaders(capture.RedactHeaders)
+		cfg.DebugCapture = &capture
+	}
+	if cfg.Mirror != nil {
+		mirror := *cfg.Mirror
+		if mirror.SampleRatio == nil {
+			mirror.SampleRatio = float64Ptr(1)
+		}
+		if mirror.MaxConcurrency == 0 {
+			mirror.MaxConcurrency = defaultMirrorMaxConcurrency
+		}
+		if mirror.MaxBodyBytes == 0 {
+			mirror.MaxBodyBytes = defaultMirrorMaxBodyBytes
+		}
+		if mirror.Timeout == 0 {
+			mirror.Timeout = defaultMirrorTimeout
+		}
+		if mirror.TagHeader == "" {
+			mirror.TagHeader = defaultMirrorTagHeader
+		}
+		if mirror.Compare != nil {
+			compare := *mirror.Compare
+			if compare.MaxBodyBytes == 0 {
+				compare.MaxBodyBytes = defaultCompareMaxBodyBytes
+			}
+			mirror.Compare = &compare
+		}
+		cfg.Mirror = &mirror
+	}
+	if cfg.StickySessions != nil {
+		sticky := *cfg.StickySessions
+		if sticky.Cookie != "" && sticky.CookiePath == "" {
+			sticky.CookiePath = "/"
+		}
+		cfg.StickySessions = &sticky
+	}
+	if cfg.Health != nil || len(cfg.Targets) > 0 || cfg.TargetsFile != nil || cfg.DNSDiscovery != nil {
+		health := healthConfig{}
+		if cfg.Health != nil {
+			health = *cfg.Health
+		}
+		if health.MaxFailures == 0 {
+			health.MaxFailures = defaultMaxFailures
+		}
+		if health.Cooldown == 0 {
+			health.Cooldown = defaultHealthCooldown
+		}
+		cfg.Health = &health
+	}
+	if cfg.LoadBalancing != nil {
+		balancing := *cfg.LoadBalancing
+		switch balancing.Algorithm {
+		case "":
+			balancing.Algorithm = algorithmRoundRobin
+		case algorithmRingHash:
+			if balancing.RingReplicas == 0 {
+				balancing.RingReplicas = defaultRingReplicas
+			}
+		case algorithmMaglev:
+			if balancing.MaglevTableSize == 0 {
+				balancing.MaglevTableSize = defaultMaglevTableSize
+			}
+		}
+		cfg.LoadBalancing = &balancing
+	}
+	if cfg.DNSDiscovery != nil {
+		discovery := *cfg.DNSDiscovery
+		if discovery.RefreshInterval == 0 {
+			discovery.RefreshInterval = defaultDNSRefreshInterval
+		}
+		if discovery.MinRefreshInterval == 0 {
+			discovery.MinRefreshInterval = defaultDNSMinRefreshInterval
+		}
+		if discovery.Timeout == 0 {
+			discovery.Timeout = defaultDNSTimeout
+		}
+		cfg.DNSDiscovery = &discovery
+	}
+	if cfg.TargetsFile != nil {
+		targetsFile := *cfg.TargetsFile
+		if targetsFile.PollInterval == 0 {
+			targetsFile.PollInterval = defaultTargetsFilePollInterval
+		}
+		cfg.TargetsFile = &targetsFile
+	}
+	if cfg.ConnectionPool != nil {
+		connections := *cfg.ConnectionPool
+		defaultTransport := http.DefaultTransport.(*http.Transport)
+		if connections.MaxIdleConns == 0 {
+			connections.MaxIdleConns = defaultTransport.MaxIdleConns
+		}
+		if connections.MaxIdleConnsPerHost == 0 {
+			connections.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+		}
+		if connections.KeepAliveInterval == 0 {
+			connections.KeepAliveInterval = defaultKeepAliveInterval
+		}
+		cfg.ConnectionPool = &connections
+	}
+	return cfg
+}
+
+// withDefaultRedactedHeaders returns the default redacted headers followed
+// by the ones of names that are not among them, so that configuring
+// redact_headers never reveals the default ones.
+func withDefaultRedactedHeaders(names []string) []string {
+	headers := append([]string{}, defaultRedactedHeaders...)
+	for _, name := range names {
+		known := false
+		for _, header := range headers {
+			known = known || strings.EqualFold(header, name)
+		}
+		if !known {
+			headers = append(headers, name)
+		}
+	}
+	return headers
+}
+
+func float64Ptr(value float64) *float64 {
+	return &value
+}
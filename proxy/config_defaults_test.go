@@ -0,0 +1,72 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Configuration validation mode", func() {
+	It("should return the effective configuration with defaults", func() {
+		effective, err := ValidateRawConfig([]byte("url: http://localhost:8080\nmirror:\n  url: http://localhost:9090\n  timeout: 2s\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(effective)).Should(ContainSubstring("url: http://localhost:8080\n"))
+		Ω(string(effective)).Should(ContainSubstring("timeout: 2s\n"))
+		Ω(string(effective)).Should(ContainSubstring("max_concurrency: 16\n"))
+		Ω(string(effective)).Should(ContainSubstring("tag_header: X-Aker-Mirror\n"))
+	})
+
+	It("should fail on invalid configuration", func() {
+		effective, err := ValidateRawConfig([]byte("url: http://localhost:8080\nmirror:\n  timeout: 2s\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(effective).Should(BeNil())
+	})
+
+	It("should not create the files named in the configuration", func() {
+		dir, err := ioutil.TempDir("", "validate")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		_, err = ValidateRawConfig([]byte("url: http://localhost:8080\naccess_log:\n  file: " + filepath.Join(dir, "access.log") + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(filepath.Join(dir, "access.log")).ShouldNot(BeAnExistingFile())
+	})
+
+	It("should fail on invalid metrics listen addresses", func() {
+		effective, err := ValidateRawConfig([]byte("url: http://localhost:8080\nmetrics:\n  listen: bogus\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("metrics.listen: "))
+		Ω(effective).Should(BeNil())
+	})
+
+	It("should fail on log files in missing directories", func() {
+		effective, err := ValidateRawConfig([]byte("url: http://localhost:8080\naccess_log:\n  file: /nonexistent/access.log\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("access_log.file: directory /nonexistent does not exist"))
+		Ω(effective).Should(BeNil())
+	})
+
+	It("should fail on unreadable targets files", func() {
+		effective, err := ValidateRawConfig([]byte("targets_file:\n  path: /nonexistent/targets.yml\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(effective).Should(BeNil())
+	})
+
+	It("should validate the configuration of a config file", func() {
+		file, err := ioutil.TempFile("", "config")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(file.Name())
+		file.WriteString("targets:\n- http://localhost:8080\n")
+		file.Close()
+
+		effective, err := ValidateRawConfig([]byte("config_file:\n  path: " + file.Name() + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(effective)).Should(ContainSubstring("- http://localhost:8080\n"))
+		Ω(string(effective)).Should(ContainSubstring("max_failures: 1\n"))
+	})
+})
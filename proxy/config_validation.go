@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/SAP/aker/plugin"
+	"gopkg.in/yaml.v2"
+)
+
+// writeAccess is the mode of access checks for writing, W_OK in access(2).
+const writeAccess = 2
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// configProblems collects the problems of a configuration, each prefixed
+// with the YAML path of the property it concerns, such as routes[0].url.
+type configProblems []string
+
+func (p configProblems) Error() string {
+	if len(p) == 1 {
+		return "invalid configuration: " + p[0]
+	}
+	return "invalid configuration:\n  " + strings.Join(p, "\n  ")
+}
+
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return p
+}
+
+func (p *configProblems) add(path, format string, args ...interface{}) {
+	*p = append(*p, path+": "+fmt.Sprintf(format, args...))
+}
+
+// unmarshalHandlerConfig resolves the references in a configuration, then
+// decodes and validates it. Unlike plugin.UnmarshalConfig, it rejects
+// properties that do not exist, so that misspelled properties do not go
+// unnoticed. Errors have the resolved secret values redacted.
+func unmarshalHandlerConfig(data []byte) (handlerConfig, error) {
+	cfg := handlerConfig{}
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return cfg, err
+	}
+	var problems configProblems
+	problems.checkProperties(document, reflect.TypeOf(cfg), "")
+	if bytes.Contains(data, []byte(referenceStart)) {
+		interpolated, err := yaml.Marshal(problems.interpolate(document, "", &cfg.secrets))
+		if err != nil {
+			return cfg, err
+		}
+		data = interpolated
+	}
+	if err := plugin.UnmarshalConfig(data, &cfg); err != nil {
+		return cfg, cfg.secrets.redact(err)
+	}
+	problems = append(problems, validateConfig(cfg)...)
+	return cfg, cfg.secrets.redact(problems.err())
+}
+
+// validateConfig returns the problems of cfg that can be found without
+// building a handler.
+func validateConfig(cfg handlerConfig) configProblems {
+	var problems configProblems
+	problems.checkTargets(cfg)
+	problems.checkProxyPath("proxy_path", cfg.ProxyPath)
+	problems.checkRequestLimits(cfg)
+	problems.checkResponseLimits(cfg)
+	if cfg.Compression != nil {
+		cfg.Compression.validate(&problems, "compression")
+	}
+	if cfg.ErrorResponses != nil {
+		cfg.ErrorResponses.validate(&problems, "error_responses")
+	}
+	for i, rule := range cfg.InterceptErrors {
+		rule.validate(&problems, fmt.Sprintf("intercept_errors[%d]", i))
+	}
+	if cfg.Metrics != nil {
+		cfg.Metrics.validate(&problems, "metrics")
+	}
+	if cfg.Tracing != nil {
+		cfg.Tracing.validate(&problems, "tracing")
+	}
+	if cfg.AccessLog != nil {
+		cfg.AccessLog.validate(&problems, "access_log")
+	}
+	if cfg.DebugCapture != nil {
+		cfg.DebugCapture.validate(&problems, "debug_capture")
+	}
+	for i, route := range cfg.Routes {
+		route.validate(&problems, fmt.Sprintf("routes[%d]", i))
+	}
+	if cfg.Canary != nil {
+		cfg.Canary.validate(&problems, "canary")
+	}
+	if cfg.Mirror != nil {
+		cfg.Mirror.validate(&problems, "mirror")
+	}
+	if cfg.StickySessions != nil {
+		cfg.StickySessions.validate(&problems, "sticky_sessions")
+	}
+	if cfg.Health != nil {
+		cfg.Health.validate(&problems, "health")
+	}
+	if cfg.LoadBalancing != nil {
+		cfg.LoadBalancing.validate(&problems, "load_balancing")
+	}
+	if cfg.ConnectionPool != nil {
+		cfg.ConnectionPool.validate(&problems, "connection_pool")
+	}
+	if cfg.EgressProxy != nil {
+		cfg.EgressProxy.validate(&problems, "egress_proxy")
+	}
+	problems.checkDurations(reflect.ValueOf(cfg), "")
+	return problems
+}
+
+// checkTargets adds the problems of the upstream targets of cfg and of the
+// properties that require targets.
+func (p *configProblems) checkTargets(cfg handlerConfig) {
+	if cfg.URL == "" && len(cfg.Targets) == 0 && cfg.TargetsFile == nil && len(cfg.Routes) == 0 && cfg.ConfigFile == nil {
+		p.add("url", "must not be empty")
+	}
+	if cfg.URL != "" {
+		p.checkUpstreamURL("url", cfg.URL)
+		if len(cfg.Targets) > 0 {
+			p.add("targets", "must not be combined with url")
+		}
+	}
+	for i, target := range cfg.Targets {
+		p.checkUpstreamURL(fmt.Sprintf("targets[%d]", i), target)
+	}
+	if cfg.TargetsFile != nil {
+		if cfg.URL != "" || len(cfg.Targets) > 0 || cfg.DNSDiscovery != nil {
+			p.add("targets_file", "must not be combined with url, targets or dns_discovery")
+		}
+		if cfg.TargetsFile.Path == "" {
+			p.add("targets_file.path", "must not be empty")
+		}
+	}
+	if cfg.DNSDiscovery != nil {
+		if cfg.URL == "" && len(cfg.Targets) == 0 {
+			p.add("dns_discovery", "requires url or targets")
+		} else {
+			if cfg.EgressProxy != nil {
+				p.add("dns_discovery", "must not be combined with egress_proxy")
+			}
+			p.checkDNSDiscovery(cfg)
+		}
+	}
+	if len(cfg.Targets) == 0 && cfg.TargetsFile == nil && cfg.DNSDiscovery == nil {
+		if cfg.StickySessions != nil {
+			p.add("sticky_sessions", "requires targets")
+		}
+		if cfg.Health != nil {
+			p.add("health", "requires targets")
+		}
+		if cfg.LoadBalancing != nil {
+			p.add("load_balancing", "requires targets")
+		}
+	}
+}
+
+// checkRatio adds a problem if ratio is set and not between 0 and 1.
+func (p *configProblems) checkRatio(path string, ratio *float64) {
+	if ratio != nil && (*ratio < 0 || *ratio > 1) {
+		p.add(path, "must be between 0 and 1")
+	}
+}
+
+// checkWritableFile adds a problem if file can not be opened for writing,
+// either because it exists and is not writable or because its directory
+// does not exist or is not writable. The file is not created.
+func (p *configProblems) checkWritableFile(path, file string) {
+	if info, err := os.Stat(file); err == nil {
+		if info.IsDir() {
+			p.add(path, "%s is a directory", file)
+		} else if syscall.Access(file, writeAccess) != nil {
+			p.add(path, "%s is not writable", file)
+		}
+		return
+	}
+	dir := filepath.Dir(file)
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		p.add(path, "directory %s does not exist", dir)
+	case err != nil:
+		p.add(path, "%v", err)
+	case !info.IsDir():
+		p.add(path, "%s is not a directory", dir)
+	case syscall.Access(dir, writeAccess) != nil:
+		p.add(path, "directory %s is not writable", dir)
+	}
+}
+
+// countSet returns the number of conditions that hold, which is used to
+// check mutually exclusive properties.
+func countSet(conditions ...bool) int {
+	n := 0
+	for _, set := range conditions {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// checkProperties adds a problem for each property of value that is not a
+// field of typ.
+func (p *configProblems) checkProperties(value interface{}, typ reflect.Type, path string) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		properties, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		fields := yamlFields(typ)
+		for _, key := range sortedProperties(properties) {
+			name := fmt.Sprint(key)
+			field, ok := fields[name]
+			if !ok {
+				p.add(joinConfigPath(path, name), "unknown property")
+				continue
+			}
+			p.checkProperties(properties[key], field.Type, joinConfigPath(path, name))
+		}
+	case reflect.Slice:
+		items, _ := value.([]interface{})
+		for i, item := range items {
+			p.checkProperties(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Map:
+		entries, _ := value.(map[interface{}]interface{})
+		for _, key := range sortedProperties(entries) {
+			p.checkProperties(entries[key], typ.Elem(), joinConfigPath(path, fmt.Sprint(key)))
+		}
+	}
+}
+
+// signedDurations are the properties whose negative durations have a
+// meaning, such as a negative flush_interval, which flushes after each write.
+var signedDurations = map[string]bool{"flush_interval": true}
+
+// checkDurations adds a problem for each negative duration in value, except
+// for the properties in signedDurations.
+func (p *configProblems) checkDurations(value reflect.Value, path string) {
+	if value.Type() == durationType {
+		if value.Int() < 0 && !signedDurations[path] {
+			p.add(path, "must not be negative")
+		}
+		return
+	}
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			p.checkDurations(value.Elem(), path)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if name, ok := yamlName(value.Type().Field(i)); ok {
+				p.checkDurations(value.Field(i), joinConfigPath(path, name))
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			p.checkDurations(value.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+func (p *configProblems) checkUpstreamURL(path, rawURL string) {
+	upstream, err := url.Parse(rawURL)
+	if err != nil {
+		p.add(path, "%v", err)
+		return
+	}
+	switch upstream.Scheme {
+	case "http", "https":
+		if upstream.Host == "" {
+			p.add(path, "host must not be empty")
+		}
+	case "unix":
+		if upstream.Host != "" {
+			p.add(path, "host must be empty, as in unix:///path/to/socket")
+		} else if socketPath, _ := splitUnixSocketPath(upstream.Path); socketPath == "" {
+			p.add(path, "socket path must not be empty")
+		}
+	case "":
+		p.add(path, "scheme must not be empty")
+	default:
+		p.add(path, "scheme must be http, https or unix: %q", upstream.Scheme)
+	}
+}
+
+func (p *configProblems) checkProxyPath(path, proxyPath string) {
+	if proxyPath != "" && !strings.HasPrefix(proxyPath, "/") {
+		p.add(path, "must start with /")
+	}
+}
+
+// yamlFields returns the fields of a struct type by their YAML names.
+func yamlFields(typ reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		if name, ok := yamlName(typ.Field(i)); ok {
+			fields[name] = typ.Field(i)
+		}
+	}
+	return fields
+}
+
+// yamlName returns the YAML name of field or false if field is not
+// decoded.
+func yamlName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "", false
+	}
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "-" {
+		return "", false
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, true
+}
+
+// sortedProperties returns the keys of properties ordered by their text.
+func sortedProperties(properties map[interface{}]interface{}) []interface{} {
+	keys := make([]interface{}, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+	return keys
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
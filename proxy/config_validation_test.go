@@ -0,0 +1,100 @@
+package proxy_test
+
+import (
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Configuration validation", func() {
+	problemsOf := func(config string) string {
+		handler, err := NewHandlerFromRawConfig([]byte(config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+		return err.Error()
+	}
+
+	It("should accept a valid configuration", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: http://localhost:8080\nproxy_path: /api\nflush_interval: 1s\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("should reject unknown properties", func() {
+		Ω(problemsOf("url: http://localhost\nproxy_pth: /api\n")).Should(ContainSubstring("proxy_pth: unknown property"))
+	})
+
+	It("should reject unknown nested properties with their path", func() {
+		problems := problemsOf("url: http://localhost\nroutes:\n- path: /a\n  url: http://localhost:8080\n  proxy_pth: /a\n")
+		Ω(problems).Should(ContainSubstring("routes[0].proxy_pth: unknown property"))
+	})
+
+	It("should reject an empty url", func() {
+		Ω(problemsOf("proxy_path: /api\n")).Should(ContainSubstring("url: must not be empty"))
+	})
+
+	It("should reject a url without scheme", func() {
+		Ω(problemsOf("url: localhost:8080\n")).Should(ContainSubstring("url: scheme must be http, https or unix"))
+	})
+
+	It("should reject a url without host", func() {
+		Ω(problemsOf("url: http:///path\n")).Should(ContainSubstring("url: host must not be empty"))
+	})
+
+	It("should accept unix socket urls", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: unix:///var/run/app.sock\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("should reject a proxy path without leading slash", func() {
+		Ω(problemsOf("url: http://localhost\nproxy_path: api\n")).Should(ContainSubstring("proxy_path: must start with /"))
+	})
+
+	It("should reject negative durations with their path", func() {
+		Ω(problemsOf("url: http://localhost\nmirror:\n  url: http://localhost:8080\n  timeout: -1s\n")).Should(ContainSubstring("mirror.timeout: must not be negative"))
+	})
+
+	It("should accept a negative flush interval", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: http://localhost:8080\nflush_interval: -1ns\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("should report all problems together", func() {
+		problems := problemsOf("url: ftp://localhost\nproxy_path: api\nupload_grace_period: -1s\ntargts: []\n")
+		Ω(problems).Should(ContainSubstring("url: scheme must be http, https or unix"))
+		Ω(problems).Should(ContainSubstring("proxy_path: must start with /"))
+		Ω(problems).Should(ContainSubstring("upload_grace_period: must not be negative"))
+		Ω(problems).Should(ContainSubstring("targts: unknown property"))
+	})
+
+	It("should report the semantic problems of all properties with their paths", func() {
+		problems := problemsOf(`url: http://localhost
+targets:
+- http://localhost:8080
+compression:
+  algorithms:
+  - gzip
+  - lzma
+canary:
+  url: http://localhost:8081
+  weight: 150
+load_balancing:
+  algorithm: maglev
+  maglev_table_size: 100
+  hash_key:
+    path: true
+sticky_sessions:
+  cookie: session
+  client_ip: true
+routes:
+- path: /a[
+  url: http://localhost:8082
+`)
+		Ω(problems).Should(ContainSubstring("targets: must not be combined with url"))
+		Ω(problems).Should(ContainSubstring(`compression.algorithms[1]: unsupported compression algorithm "lzma"`))
+		Ω(problems).Should(ContainSubstring("canary.weight: must be between 0 and 100"))
+		Ω(problems).Should(ContainSubstring("load_balancing.maglev_table_size: must be a prime number"))
+		Ω(problems).Should(ContainSubstring("sticky_sessions: must set exactly one of cookie, app_cookie, header or client_ip"))
+		Ω(problems).Should(ContainSubstring("routes[0].path: invalid path pattern"))
+	})
+})
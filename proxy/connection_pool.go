@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SAP/gologger"
+)
+
+// HTTP versions of upstream connections.
+const (
+	httpVersion11 = "1.1"
+	httpVersion2  = "2"
+)
+
+const (
+	defaultDialTimeout       = 30 * time.Second
+	defaultKeepAliveInterval = 30 * time.Second
+)
+
+var errConnectionQueueTimeout = errors.New("no upstream connection became available within the configured queue timeout")
+
+type connectionPoolConfig struct {
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `yaml:"max_conns_per_host"`
+	QueueTimeout        time.Duration `yaml:"queue_timeout"`
+	KeepAliveInterval   time.Duration `yaml:"keep_alive_interval"`
+	DisableKeepAlives   bool          `yaml:"disable_keep_alives"`
+	HTTPVersion         string        `yaml:"http_version"`
+}
+
+// connectionPool is the transport of the upstream connections. Once
+// metrics is set, it records the connections it opens and how requests
+// obtain them.
+type connectionPool struct {
+	transport    *http.Transport
+	queueTimeout time.Duration
+	metrics      *proxyMetrics
+}
+
+func (cfg connectionPoolConfig) validate(p *configProblems, path string) {
+	if cfg.MaxIdleConns < 0 {
+		p.add(path+".max_idle_conns", "must not be negative")
+	}
+	if cfg.MaxIdleConnsPerHost < 0 {
+		p.add(path+".max_idle_conns_per_host", "must not be negative")
+	}
+	if cfg.MaxConnsPerHost < 0 {
+		p.add(path+".max_conns_per_host", "must not be negative")
+	}
+	if cfg.QueueTimeout > 0 && cfg.MaxConnsPerHost == 0 {
+		p.add(path+".queue_timeout", "requires max_conns_per_host")
+	}
+	switch cfg.HTTPVersion {
+	case "", httpVersion11, httpVersion2:
+	default:
+		p.add(path+".http_version", "unsupported http_version %q", cfg.HTTPVersion)
+	}
+}
+
+func newConnectionPool(cfg connectionPoolConfig) (*connectionPool, error) {
+	p := &connectionPool{queueTimeout: cfg.QueueTimeout}
+	dialer := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: cfg.KeepAliveInterval}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dial := dialUpstream(dialer)
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return p.track(conn, address), nil
+	}
+	transport.MaxIdleConns = cfg.MaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = cfg.MaxConnsPerHost
+	transport.DisableKeepAlives = cfg.DisableKeepAlives
+
+	switch cfg.HTTPVersion {
+	case "":
+	case httpVersion11:
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+	case httpVersion2:
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("unsupported connection_pool http_version %q", cfg.HTTPVersion)
+	}
+	p.transport = transport
+	return p, nil
+}
+
+// closeIdleConnectionsOnStop closes the idle connections of transport once
+// stop is closed.
+func closeIdleConnectionsOnStop(transport *http.Transport, stop <-chan struct{}) {
+	go func() {
+		<-stop
+		transport.CloseIdleConnections()
+	}()
+}
+
+// WrapTransport returns a round tripper that records how the requests sent
+// through next obtain their connections and fails them if they wait longer
+// than the queue timeout for one.
+func (p *connectionPool) WrapTransport(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		upstream := upstreamLabel(req.URL)
+		start := time.Now()
+		var gotConn, timedOut int32
+		ctx, cancel := context.WithCancel(req.Context())
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				if !atomic.CompareAndSwapInt32(&gotConn, 0, 1) {
+					return
+				}
+				if p.metrics != nil {
+					p.metrics.connectionWait.observe(time.Since(start).Seconds(), upstream)
+					p.metrics.connectionUses.add(1, upstream, fmt.Sprint(info.Reused))
+				}
+			},
+		}
+		if p.queueTimeout > 0 {
+			timer := time.AfterFunc(p.queueTimeout, func() {
+				if atomic.CompareAndSwapInt32(&gotConn, 0, 1) {
+					atomic.StoreInt32(&timedOut, 1)
+					cancel()
+				}
+			})
+			defer timer.Stop()
+		}
+
+		resp, err := next.RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+		if err != nil {
+			cancel()
+			if atomic.LoadInt32(&timedOut) == 1 {
+				gologger.Warnf("Request %s waited longer than %v for a connection to %s", requestID(req), p.queueTimeout, upstream)
+				if p.metrics != nil {
+					p.metrics.connectionQueueTimeouts.add(1, upstream)
+				}
+				return nil, errConnectionQueueTimeout
+			}
+			return nil, err
+		}
+		if upgraded, ok := resp.Body.(io.ReadWriteCloser); ok {
+			// The body of an upgraded connection must stay writable.
+			resp.Body = &cancelingReadWriteBody{ReadWriteCloser: upgraded, cancel: cancel}
+		} else {
+			resp.Body = &cancelingBody{ReadCloser: resp.Body, cancel: cancel}
+		}
+		return resp, nil
+	})
+}
+
+// track returns conn, which is counted as open to address until it is
+// closed.
+func (p *connectionPool) track(conn net.Conn, address string) net.Conn {
+	if p.metrics == nil {
+		return conn
+	}
+	p.metrics.openConnections.add(1, address)
+	return &trackedConn{Conn: conn, close: func() { p.metrics.openConnections.add(-1, address) }}
+}
+
+type trackedConn struct {
+	net.Conn
+	closeOnce sync.Once
+	close     func()
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(c.close)
+	return c.Conn.Close()
+}
+
+// cancelingBody cancels the context of its request once it is closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+type cancelingReadWriteBody struct {
+	io.ReadWriteCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingReadWriteBody) Close() error {
+	err := b.ReadWriteCloser.Close()
+	b.cancel()
+	return err
+}
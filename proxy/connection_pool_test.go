@@ -0,0 +1,159 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Connection pool", func() {
+	var upstream *httptest.Server
+	var requests chan *http.Request
+	var release chan struct{}
+
+	BeforeEach(func() {
+		requests = make(chan *http.Request, 10)
+		release = make(chan struct{})
+		upstream = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			requests <- req
+			<-release
+		}))
+		upstream.Config.Protocols = new(http.Protocols)
+		upstream.Config.Protocols.SetHTTP1(true)
+		upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+		upstream.Start()
+	})
+
+	AfterEach(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+		upstream.Close()
+	})
+
+	serve := func(handler http.Handler) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/path", nil))
+		return recorder
+	}
+
+	It("should fail requests that wait longer than the queue timeout for a connection", func() {
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL + "\nconnection_pool:\n  max_conns_per_host: 1\n  queue_timeout: 100ms\n  http_version: \"1.1\"\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		done := make(chan int)
+		go func() {
+			done <- serve(handler).Code
+		}()
+		Eventually(requests).Should(Receive())
+
+		start := time.Now()
+		Ω(serve(handler).Code).Should(Equal(http.StatusServiceUnavailable))
+		Ω(time.Since(start)).Should(BeNumerically("<", time.Second))
+
+		close(release)
+		Eventually(done).Should(Receive(Equal(http.StatusOK)))
+	})
+
+	It("should queue requests until a connection is available", func() {
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL + "\nconnection_pool:\n  max_conns_per_host: 1\n  queue_timeout: 5s\n  http_version: \"1.1\"\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		done := make(chan int, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				done <- serve(handler).Code
+			}()
+		}
+		Eventually(requests).Should(Receive())
+		Consistently(requests, 100*time.Millisecond).ShouldNot(Receive())
+
+		close(release)
+		Eventually(done).Should(Receive(Equal(http.StatusOK)))
+		Eventually(done).Should(Receive(Equal(http.StatusOK)))
+	})
+
+	It("should disable keep-alives", func() {
+		close(release)
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL + "\nconnection_pool:\n  disable_keep_alives: true\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+		var req *http.Request
+		Eventually(requests).Should(Receive(&req))
+		Ω(req.Close).Should(BeTrue())
+	})
+
+	It("should force HTTP/2", func() {
+		close(release)
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL + "\nconnection_pool:\n  http_version: \"2\"\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+		var req *http.Request
+		Eventually(requests).Should(Receive(&req))
+		Ω(req.ProtoMajor).Should(Equal(2))
+	})
+
+	It("should force HTTP/1.1", func() {
+		close(release)
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL + "\nconnection_pool:\n  http_version: \"1.1\"\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+		var req *http.Request
+		Eventually(requests).Should(Receive(&req))
+		Ω(req.ProtoMajor).Should(Equal(1))
+	})
+
+	It("should expose connection metrics", func() {
+		close(release)
+		socketDir, err := ioutil.TempDir("", "metrics")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(socketDir)
+		socketPath := filepath.Join(socketDir, "metrics.sock")
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL + "\nconnection_pool:\n  max_idle_conns_per_host: 4\nmetrics:\n  listen: unix:" + socketPath + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+		Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+
+		client := &http.Client{Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		}}
+		resp, err := client.Get("http://localhost/metrics")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer resp.Body.Close()
+		content, err := ioutil.ReadAll(resp.Body)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		address := upstream.Listener.Addr().String()
+		Ω(string(content)).Should(ContainSubstring(`aker_proxy_upstream_connections_open{address="` + address + `"} 1`))
+		Ω(string(content)).Should(ContainSubstring(`aker_proxy_upstream_connection_uses_total{upstream="` + upstream.URL + `",reused="false"} 1`))
+		Ω(string(content)).Should(ContainSubstring(`aker_proxy_upstream_connection_uses_total{upstream="` + upstream.URL + `",reused="true"} 1`))
+		Ω(string(content)).Should(ContainSubstring(`aker_proxy_upstream_connection_wait_seconds_count{upstream="` + upstream.URL + `"} 2`))
+	})
+
+	It("should reject a queue timeout without connection limit", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL + "\nconnection_pool:\n  queue_timeout: 1s\n"))
+		Ω(err).Should(MatchError(ContainSubstring("connection_pool.queue_timeout: requires max_conns_per_host")))
+	})
+
+	It("should reject unsupported HTTP versions", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL + "\nconnection_pool:\n  http_version: \"3\"\n"))
+		Ω(err).Should(MatchError(ContainSubstring("connection_pool.http_version: unsupported http_version")))
+	})
+})
@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SAP/gologger"
+)
+
+const (
+	defaultCaptureMaxBodyBytes = 4096
+	redactedValue              = "[REDACTED]"
+)
+
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+type debugCaptureConfig struct {
+	Match            []captureMatchConfig `yaml:"match"`
+	MaxBodyBytes     int64                `yaml:"max_body_bytes"`
+	RedactHeaders    []string             `yaml:"redact_headers"`
+	RedactJSONFields []string             `yaml:"redact_json_fields"`
+	File             string               `yaml:"file"`
+}
+
+type captureMatchConfig struct {
+	Path    string            `yaml:"path"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+type captureKey struct{}
+
+// debugCapture records the headers and the beginning of the bodies of
+// upstream round trips for requests matching one of the configured rules.
+type debugCapture struct {
+	match         []captureMatchConfig
+	maxBodyBytes  int64
+	redactHeaders map[string]bool
+	redactFields  map[string]bool
+	fieldPattern  *regexp.Regexp
+	output        io.Writer
+}
+
+// captureRecord is a captured upstream round trip.
+type captureRecord struct {
+	Time                  time.Time           `json:"time"`
+	RequestID             string              `json:"request_id"`
+	Method                string              `json:"method"`
+	URL                   string              `json:"url"`
+	RequestHeaders        map[string][]string `json:"request_headers"`
+	RequestBody           string              `json:"request_body,omitempty"`
+	RequestBodyTruncated  bool                `json:"request_body_truncated,omitempty"`
+	Status                int                 `json:"status,omitempty"`
+	ResponseHeaders       map[string][]string `json:"response_headers,omitempty"`
+	ResponseBody          string              `json:"response_body,omitempty"`
+	ResponseBodyTruncated bool                `json:"response_body_truncated,omitempty"`
+	Error                 string              `json:"error,omitempty"`
+}
+
+func (cfg debugCaptureConfig) validate(p *configProblems, path string) {
+	if len(cfg.Match) == 0 {
+		p.add(path+".match", "must not be empty")
+	}
+	for i, rule := range cfg.Match {
+		if rule.Path == "" && rule.Method == "" && len(rule.Headers) == 0 {
+			p.add(fmt.Sprintf("%s.match[%d]", path, i), "must set path, method or headers")
+		}
+	}
+	if cfg.MaxBodyBytes < 0 {
+		p.add(path+".max_body_bytes", "must not be negative")
+	}
+	if cfg.File != "" {
+		p.checkWritableFile(path+".file", cfg.File)
+	}
+}
+
+func newDebugCapture(cfg debugCaptureConfig) (*debugCapture, error) {
+	capture := &debugCapture{
+		match:         cfg.Match,
+		maxBodyBytes:  cfg.MaxBodyBytes,
+		redactHeaders: make(map[string]bool),
+		redactFields:  make(map[string]bool),
+		output:        gologgerWriter{},
+	}
+
+	for _, name := range cfg.RedactHeaders {
+		capture.redactHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	if len(cfg.RedactJSONFields) > 0 {
+		quoted := make([]string, len(cfg.RedactJSONFields))
+		for i, field := range cfg.RedactJSONFields {
+			capture.redactFields[strings.ToLower(field)] = true
+			quoted[i] = regexp.QuoteMeta(field)
+		}
+		capture.fieldPattern = regexp.MustCompile(`(?i)("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]+)`)
+	}
+
+	if cfg.File != "" {
+		file, err := openRotatingFile(cfg.File, defaultAccessLogMaxFileBytes, defaultAccessLogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		capture.output = file
+	}
+	return capture, nil
+}
+
+// Wrap returns a handler that marks requests matching a capture rule, so
+// that their upstream round trips are captured by the transport returned by
+// WrapTransport.
+func (c *debugCapture) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, rule := range c.match {
+			if rule.matches(req) {
+				req = req.WithContext(context.WithValue(req.Context(), captureKey{}, true))
+				break
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// WrapTransport returns a round tripper that captures the marked requests
+// sent through next.
+func (c *debugCapture) WrapTransport(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if captured, _ := req.Context().Value(captureKey{}).(bool); !captured {
+			return next.RoundTrip(req)
+		}
+
+		record := &captureRecord{
+			Time:           time.Now(),
+			RequestID:      requestID(req),
+			Method:         req.Method,
+			URL:            redactQuery(req.URL),
+			RequestHeaders: c.redactHeader(req.Header),
+		}
+		var requestBody *captureBuffer
+		if req.Body != nil && req.Body != http.NoBody {
+			requestBody = &captureBuffer{max: c.maxBodyBytes}
+			clone := new(http.Request)
+			*clone = *req
+			clone.Body = &capturedBody{ReadCloser: req.Body, buffer: requestBody}
+			req = clone
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			record.Error = err.Error()
+			c.write(record, req.Header, requestBody, nil, nil)
+			return nil, err
+		}
+		record.Status = resp.StatusCode
+		record.ResponseHeaders = c.redactHeader(resp.Header)
+		responseBody := &captureBuffer{max: c.maxBodyBytes}
+		var once sync.Once
+		resp.Body = &capturedBody{
+			ReadCloser: resp.Body,
+			buffer:     responseBody,
+			done: func() {
+				once.Do(func() { c.write(record, req.Header, requestBody, resp.Header, responseBody) })
+			},
+		}
+		return resp, nil
+	})
+}
+
+func (c *debugCapture) write(record *captureRecord, requestHeader http.Header, requestBody *captureBuffer, responseHeader http.Header, responseBody *captureBuffer) {
+	if requestBody != nil {
+		record.RequestBody, record.RequestBodyTruncated = c.redactBody(requestHeader, requestBody)
+	}
+	if responseBody != nil {
+		record.ResponseBody, record.ResponseBodyTruncated = c.redactBody(responseHeader, responseBody)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		gologger.Errorf("Error formatting debug capture of request %s: %v", record.RequestID, err)
+		return
+	}
+	if _, err := c.output.Write(append(line, '\n')); err != nil {
+		gologger.Errorf("Error writing debug capture of request %s: %v", record.RequestID, err)
+	}
+}
+
+func (c *debugCapture) redactHeader(header http.Header) map[string][]string {
+	redacted := make(map[string][]string, len(header))
+	for name, values := range header {
+		if c.redactHeaders[http.CanonicalHeaderKey(name)] {
+			redacted[name] = []string{redactedValue}
+		} else {
+			redacted[name] = append([]string(nil), values...)
+		}
+	}
+	return redacted
+}
+
+// redactBody returns the captured body with the configured JSON fields
+// redacted. Complete JSON documents are redacted field by field at any
+// depth. Truncated or malformed documents fall back to a pattern, so that
+// sensitive values are hidden even if the capture ends within them.
+func (c *debugCapture) redactBody(header http.Header, buffer *captureBuffer) (string, bool) {
+	body, truncated := buffer.contents()
+	if len(c.redactFields) == 0 || !isJSONContent(header.Get("Content-Type")) {
+		return string(body), truncated
+	}
+	if !truncated {
+		var document interface{}
+		if err := json.Unmarshal(body, &document); err == nil {
+			redacted, err := json.Marshal(c.redactJSON(document))
+			if err == nil {
+				return string(redacted), false
+			}
+		}
+	}
+	return c.fieldPattern.ReplaceAllString(string(body), `${1}"`+redactedValue+`"`), truncated
+}
+
+func (c *debugCapture) redactJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if c.redactFields[strings.ToLower(key)] {
+				value[key] = redactedValue
+			} else {
+				value[key] = c.redactJSON(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range value {
+			value[i] = c.redactJSON(child)
+		}
+	}
+	return value
+}
+
+func isJSONContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// matches reports whether all criteria of the rule match req.
+func (r captureMatchConfig) matches(req *http.Request) bool {
+	if r.Path != "" && !matchPath(r.Path, req.URL.Path) {
+		return false
+	}
+	if r.Method != "" && !strings.EqualFold(req.Method, r.Method) {
+		return false
+	}
+	for name, value := range r.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// captureBuffer keeps the first max bytes written to it. It is safe for
+// concurrent use, as request bodies are read by the transport while the
+// response is being processed.
+type captureBuffer struct {
+	max       int64
+	mutex     sync.Mutex
+	data      []byte
+	truncated bool
+}
+
+// Write always succeeds, so that it can be used for reading bodies
+// completely.
+func (b *captureBuffer) Write(data []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	n := len(data)
+	remaining := b.max - int64(len(b.data))
+	if int64(len(data)) > remaining {
+		data = data[:remaining]
+		b.truncated = true
+	}
+	b.data = append(b.data, data...)
+	return n, nil
+}
+
+func (b *captureBuffer) contents() ([]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]byte(nil), b.data...), b.truncated
+}
+
+// capturedBody copies the data read from a body into a captureBuffer and
+// calls done once the body has been read completely or closed. complete
+// reports whether the body has been read up to its end.
+type capturedBody struct {
+	io.ReadCloser
+	buffer   *captureBuffer
+	done     func()
+	complete bool
+}
+
+func (b *capturedBody) Read(data []byte) (int, error) {
+	n, err := b.ReadCloser.Read(data)
+	b.buffer.Write(data[:n])
+	if err == io.EOF {
+		b.complete = true
+	}
+	if err != nil && b.done != nil {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *capturedBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.done != nil {
+		b.done()
+	}
+	return err
+}
+
+// redactQuery returns u with the values of its query parameters replaced
+// with [REDACTED], as they may carry credentials such as API keys.
+func redactQuery(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	redacted := *u
+	parameters := strings.Split(u.RawQuery, "&")
+	for i, parameter := range parameters {
+		if j := strings.Index(parameter, "="); j >= 0 {
+			parameters[i] = parameter[:j+1] + redactedValue
+		}
+	}
+	redacted.RawQuery = strings.Join(parameters, "&")
+	return redacted.String()
+}
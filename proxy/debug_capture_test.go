@@ -0,0 +1,172 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Debug capture", func() {
+	var fakeServer *ghttp.Server
+	var captureDir string
+	var captureFile string
+	var captureConfig string
+	var request *http.Request
+	var response *httptest.ResponseRecorder
+
+	captures := func() []map[string]interface{} {
+		content, err := ioutil.ReadFile(captureFile)
+		Ω(err).ShouldNot(HaveOccurred())
+		var records []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			if line == "" {
+				continue
+			}
+			var record map[string]interface{}
+			Ω(json.Unmarshal([]byte(line), &record)).Should(Succeed())
+			records = append(records, record)
+		}
+		return records
+	}
+
+	BeforeEach(func() {
+		fakeServer = ghttp.NewServer()
+		fakeServer.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+			ioutil.ReadAll(req.Body)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Set-Cookie", "session=secret")
+			w.Write([]byte(`{"user":"alice","token":"abc","nested":[{"Password":"pw"}]}`))
+		})
+
+		var err error
+		captureDir, err = ioutil.TempDir("", "capture")
+		Ω(err).ShouldNot(HaveOccurred())
+		captureFile = filepath.Join(captureDir, "capture.log")
+		captureConfig = "  match:\n  - path: /api/*\n  redact_json_fields: [token, password]\n"
+
+		request, err = http.NewRequest("POST", "http://example.com/api/login?api_key=secret&debug", strings.NewReader(`{"user":"alice","password":"secret"}`))
+		Ω(err).ShouldNot(HaveOccurred())
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer secret")
+		request.Header.Set("X-Aker-Request-Id", "some-request-id")
+		response = httptest.NewRecorder()
+	})
+
+	AfterEach(func() {
+		fakeServer.Close()
+		os.RemoveAll(captureDir)
+	})
+
+	JustBeforeEach(func() {
+		config := "url: " + fakeServer.URL() + "\npreserve_internal_headers: true\ndebug_capture:\n  file: " + captureFile + "\n" + captureConfig
+		handler, err := NewHandlerFromRawConfig([]byte(config))
+		Ω(err).ShouldNot(HaveOccurred())
+		handler.ServeHTTP(response, request)
+	})
+
+	Context("when the request matches", func() {
+		It("should capture the round trip", func() {
+			Ω(response.Body.String()).Should(ContainSubstring(`"token":"abc"`))
+
+			records := captures()
+			Ω(records).Should(HaveLen(1))
+			record := records[0]
+			Ω(record).Should(HaveKeyWithValue("request_id", "some-request-id"))
+			Ω(record).Should(HaveKeyWithValue("method", "POST"))
+			Ω(record).Should(HaveKeyWithValue("url", fakeServer.URL()+"/api/login?api_key=[REDACTED]&debug"))
+			Ω(record).Should(HaveKeyWithValue("status", BeNumerically("==", http.StatusOK)))
+			Ω(record).Should(HaveKeyWithValue("request_body", `{"password":"[REDACTED]","user":"alice"}`))
+			Ω(record).Should(HaveKeyWithValue("response_body", `{"nested":[{"Password":"[REDACTED]"}],"token":"[REDACTED]","user":"alice"}`))
+		})
+
+		It("should redact sensitive headers", func() {
+			record := captures()[0]
+			Ω(record["request_headers"]).Should(HaveKeyWithValue("Authorization", ConsistOf("[REDACTED]")))
+			Ω(record["request_headers"]).Should(HaveKeyWithValue("Content-Type", ConsistOf("application/json")))
+			Ω(record["response_headers"]).Should(HaveKeyWithValue("Set-Cookie", ConsistOf("[REDACTED]")))
+		})
+
+		Context("with additional redacted headers", func() {
+			BeforeEach(func() {
+				captureConfig += "  redact_headers: [Content-Type]\n"
+			})
+
+			It("should redact the default headers as well", func() {
+				record := captures()[0]
+				Ω(record["request_headers"]).Should(HaveKeyWithValue("Authorization", ConsistOf("[REDACTED]")))
+				Ω(record["request_headers"]).Should(HaveKeyWithValue("Content-Type", ConsistOf("[REDACTED]")))
+				Ω(record["response_headers"]).Should(HaveKeyWithValue("Set-Cookie", ConsistOf("[REDACTED]")))
+			})
+		})
+	})
+
+	Context("when the body exceeds the capture size", func() {
+		BeforeEach(func() {
+			captureConfig += "  max_body_bytes: 30\n"
+		})
+
+		It("should redact the truncated body", func() {
+			record := captures()[0]
+			Ω(record).Should(HaveKeyWithValue("request_body", `{"user":"alice","password":"[REDACTED]"`))
+			Ω(record).Should(HaveKeyWithValue("request_body_truncated", true))
+			Ω(record).Should(HaveKeyWithValue("response_body_truncated", true))
+		})
+	})
+
+	Context("when the request does not match", func() {
+		BeforeEach(func() {
+			request.URL.Path = "/other"
+		})
+
+		It("should not capture the round trip", func() {
+			Ω(response.Code).Should(Equal(http.StatusOK))
+			Ω(captures()).Should(BeEmpty())
+		})
+	})
+
+	Context("when matching on headers", func() {
+		BeforeEach(func() {
+			captureConfig = "  match:\n  - headers:\n      X-Debug: \"1\"\n"
+		})
+
+		It("should not capture requests without the header", func() {
+			Ω(captures()).Should(BeEmpty())
+		})
+
+		Context("and the request carries the header", func() {
+			BeforeEach(func() {
+				request.Header.Set("X-Debug", "1")
+			})
+
+			It("should capture the round trip", func() {
+				Ω(captures()).Should(HaveLen(1))
+			})
+		})
+	})
+})
+
+var _ = Describe("Debug capture configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost\ndebug_capture:\n" + config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail without match rules", func() {
+		itShouldFail("  max_body_bytes: 10\n")
+	})
+
+	It("should fail on empty match rules", func() {
+		itShouldFail("  match:\n  - {}\n")
+	})
+})
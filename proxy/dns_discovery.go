@@ -0,0 +1,572 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SAP/gologger"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSRefreshInterval    = 30 * time.Second
+	defaultDNSMinRefreshInterval = time.Second
+	defaultDNSTimeout            = 5 * time.Second
+	defaultDNSNdots              = 1
+	resolvConfPath               = "/etc/resolv.conf"
+	hostsPath                    = "/etc/hosts"
+)
+
+// noTTL is the TTL of addresses that do not expire, such as those of the
+// hosts file.
+const noTTL = time.Duration(math.MaxUint32) * time.Second
+
+type dnsDiscoveryConfig struct {
+	RefreshInterval    time.Duration `yaml:"refresh_interval"`
+	MinRefreshInterval time.Duration `yaml:"min_refresh_interval"`
+	SRV                bool          `yaml:"srv"`
+	Servers            []string      `yaml:"servers"`
+	Timeout            time.Duration `yaml:"timeout"`
+}
+
+// dnsDiscovery resolves the host names of the targets of a pool and
+// balances across the resolved addresses. Names are resolved again when
+// the shortest TTL of their records expires, but at least every refresh
+// interval. If a name can not be resolved, the addresses it was resolved
+// to last are kept, and until it has been resolved, requests are sent to
+// the unresolved URL.
+type dnsDiscovery struct {
+	client             *dnsClient
+	pool               *targetPool
+	sources            []*url.URL
+	fallbacks          []*poolTarget
+	resolved           [][]*poolTarget
+	srv                bool
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+}
+
+// checkDNSDiscovery adds the problems of the dns_discovery of cfg, which
+// concern the targets it resolves as well.
+func (p *configProblems) checkDNSDiscovery(cfg handlerConfig) {
+	discovery := withDefaults(cfg).DNSDiscovery
+	if discovery.MinRefreshInterval > discovery.RefreshInterval {
+		p.add("dns_discovery.min_refresh_interval", "must not exceed refresh_interval")
+	}
+
+	targets := map[string]string{"url": cfg.URL}
+	if cfg.URL == "" {
+		targets = make(map[string]string, len(cfg.Targets))
+		for i, target := range cfg.Targets {
+			targets[fmt.Sprintf("targets[%d]", i)] = target
+		}
+	}
+	paths := make([]string, 0, len(targets))
+	for path := range targets {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		target, err := url.Parse(targets[path])
+		if err != nil {
+			continue
+		}
+		if target.Scheme == unixSocketScheme {
+			p.add(path, "dns_discovery requires http or https URLs")
+		} else if cfg.DNSDiscovery.SRV && target.Port() != "" {
+			p.add(path, "dns_discovery of SRV records requires URLs without port")
+		}
+	}
+}
+
+// discoverTargets replaces the targets of pool with the addresses their
+// host names resolve to and keeps them up to date until stop is closed.
+// Names are resolved in the background, so that the pool keeps the
+// unresolved targets until the first resolution completes.
+func discoverTargets(cfg *dnsDiscoveryConfig, pool *targetPool, stop <-chan struct{}) {
+	d := &dnsDiscovery{
+		pool:               pool,
+		srv:                cfg.SRV,
+		refreshInterval:    cfg.RefreshInterval,
+		minRefreshInterval: cfg.MinRefreshInterval,
+	}
+	d.client = newDNSClient(cfg.Servers, cfg.Timeout)
+	for _, target := range pool.targets {
+		d.sources = append(d.sources, target.url)
+		d.fallbacks = append(d.fallbacks, target)
+	}
+	d.resolved = make([][]*poolTarget, len(d.sources))
+
+	go d.run(stop)
+}
+
+func (d *dnsDiscovery) run(stop <-chan struct{}) {
+	wait := d.resolve()
+	for {
+		select {
+		case <-time.After(wait):
+			wait = d.resolve()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// resolve resolves all sources, updates the targets of the pool and
+// returns the time until the sources are to be resolved again.
+func (d *dnsDiscovery) resolve() time.Duration {
+	wait := d.refreshInterval
+	var targets []*poolTarget
+	for i, source := range d.sources {
+		resolved, ttl, err := d.resolveSource(source)
+		if err != nil {
+			if d.resolved[i] == nil {
+				gologger.Errorf("DNS discovery of %s failed, sending requests to the unresolved URL: %v", source.Host, err)
+				targets = append(targets, d.fallbacks[i])
+				continue
+			}
+			gologger.Warnf("DNS discovery of %s failed, keeping %d known targets: %v", source.Host, len(d.resolved[i]), err)
+		} else {
+			if !sameTargets(d.resolved[i], resolved) {
+				gologger.Infof("DNS discovery of %s found %d targets", source.Host, len(resolved))
+			}
+			d.resolved[i] = resolved
+			if ttl < wait {
+				wait = ttl
+			}
+		}
+		targets = append(targets, d.resolved[i]...)
+	}
+	d.pool.update(targets)
+	if wait < d.minRefreshInterval {
+		wait = d.minRefreshInterval
+	}
+	return wait
+}
+
+func (d *dnsDiscovery) resolveSource(source *url.URL) ([]*poolTarget, time.Duration, error) {
+	if ip := net.ParseIP(source.Hostname()); ip != nil {
+		return []*poolTarget{newPoolTarget(source)}, d.refreshInterval, nil
+	}
+	if !d.srv {
+		ips, ttl, err := d.client.lookupIPs(source.Hostname())
+		if err != nil {
+			return nil, 0, err
+		}
+		port := source.Port()
+		if port == "" {
+			port = defaultPort(source.Scheme)
+		}
+		var targets []*poolTarget
+		for _, ip := range ips {
+			targets = append(targets, newDiscoveredTarget(source, ip, port, source.Host))
+		}
+		return targets, ttl, nil
+	}
+
+	records, ttl, err := d.client.lookupSRV(source.Hostname())
+	if err != nil {
+		return nil, 0, err
+	}
+	var targets []*poolTarget
+	for _, record := range records {
+		port := strconv.Itoa(int(record.port))
+		host := net.JoinHostPort(record.name, port)
+		for _, ip := range record.ips {
+			targets = append(targets, newDiscoveredTarget(source, ip, port, host))
+		}
+	}
+	return targets, ttl, nil
+}
+
+// newDiscoveredTarget returns a target that sends requests to ip but names
+// host in the Host header and, for HTTPS, in the TLS handshake.
+func newDiscoveredTarget(source *url.URL, ip net.IP, port, host string) *poolTarget {
+	target := *source
+	target.Host = net.JoinHostPort(ip.String(), port)
+	hash := sha1.Sum([]byte(target.String() + " " + host))
+	discovered := &poolTarget{url: &target, host: host, id: hex.EncodeToString(hash[:8])}
+	if target.Scheme == "https" {
+		discovered.serverName = strings.TrimSuffix(hostOnly(host), ".")
+	}
+	return discovered
+}
+
+func sameTargets(a, b []*poolTarget) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].id != b[i].id {
+			return false
+		}
+	}
+	return true
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+// dnsClient queries name servers directly, as the resolver of the standard
+// library does not report the TTLs of records. With the name servers of
+// the system, it also applies the hosts file and the search domains of the
+// system like the resolver of the standard library.
+type dnsClient struct {
+	servers   []string
+	timeout   time.Duration
+	search    []string
+	ndots     int
+	hostsFile string
+}
+
+type srvRecord struct {
+	name string
+	port uint16
+	ips  []net.IP
+}
+
+func newDNSClient(servers []string, timeout time.Duration) *dnsClient {
+	client := &dnsClient{timeout: timeout}
+	if len(servers) == 0 {
+		servers, client.search, client.ndots = systemResolverConfig()
+		client.hostsFile = hostsPath
+	}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		client.servers = append(client.servers, server)
+	}
+	return client
+}
+
+// systemResolverConfig returns the name servers, search domains and ndots
+// option of /etc/resolv.conf. The name servers default to the local name
+// server.
+func systemResolverConfig() (servers, search []string, ndots int) {
+	ndots = defaultDNSNdots
+	file, err := os.Open(resolvConfPath)
+	if err != nil {
+		return []string{"127.0.0.1"}, nil, ndots
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			servers = append(servers, fields[1])
+		case "domain", "search":
+			// The last domain or search line takes effect.
+			search = fields[1:]
+		case "options":
+			for _, option := range fields[1:] {
+				if value := strings.TrimPrefix(option, "ndots:"); value != option {
+					if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+						ndots = n
+					}
+				}
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1"}
+	}
+	return servers, search, ndots
+}
+
+// candidateNames returns the fully qualified names to query for name in
+// turn. Names with fewer dots than ndots are tried with the search domains
+// first.
+func (c *dnsClient) candidateNames(name string) []string {
+	if strings.HasSuffix(name, ".") || len(c.search) == 0 {
+		return []string{name}
+	}
+	var searched []string
+	for _, domain := range c.search {
+		searched = append(searched, name+"."+strings.TrimSuffix(domain, ".")+".")
+	}
+	if strings.Count(name, ".") >= c.ndots {
+		return append([]string{name}, searched...)
+	}
+	return append(searched, name)
+}
+
+// lookupHosts returns the addresses of name in the hosts file.
+func (c *dnsClient) lookupHosts(name string) []net.IP {
+	if c.hostsFile == "" {
+		return nil
+	}
+	file, err := os.Open(c.hostsFile)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	name = strings.TrimSuffix(name, ".")
+	var ips []net.IP
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, alias := range fields[1:] {
+			if strings.EqualFold(strings.TrimSuffix(alias, "."), name) {
+				ips = append(ips, ip)
+				break
+			}
+		}
+	}
+	return ips
+}
+
+// lookupIPs returns the IPv4 and IPv6 addresses of name and the shortest
+// TTL of their records. Addresses of the hosts file do not expire.
+func (c *dnsClient) lookupIPs(name string) ([]net.IP, time.Duration, error) {
+	if ips := c.lookupHosts(name); len(ips) > 0 {
+		return ips, noTTL, nil
+	}
+	var firstErr error
+	for _, candidate := range c.candidateNames(name) {
+		ips, ttl, err := c.queryIPs(candidate)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, 0, firstErr
+}
+
+func (c *dnsClient) queryIPs(name string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	ttl := uint32(math.MaxUint32)
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, err := c.query(name, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, answer := range msg.Answers {
+			ip := resourceIP(answer)
+			if ip == nil {
+				continue
+			}
+			ips = append(ips, ip)
+			ttl = minTTL(ttl, answer.Header.TTL)
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr != nil {
+			return nil, 0, lastErr
+		}
+		return nil, 0, fmt.Errorf("no addresses found for %s", name)
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// lookupSRV returns the SRV records of name with the lowest priority, the
+// addresses of their targets and the shortest TTL of all records.
+func (c *dnsClient) lookupSRV(name string) ([]srvRecord, time.Duration, error) {
+	var firstErr error
+	for _, candidate := range c.candidateNames(name) {
+		records, ttl, err := c.querySRV(candidate)
+		if err == nil {
+			return records, ttl, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, 0, firstErr
+}
+
+func (c *dnsClient) querySRV(name string) ([]srvRecord, time.Duration, error) {
+	msg, err := c.query(name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl := uint32(math.MaxUint32)
+	var records []srvRecord
+	priority := -1
+	for _, answer := range msg.Answers {
+		srv, ok := answer.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		ttl = minTTL(ttl, answer.Header.TTL)
+		if priority != -1 && int(srv.Priority) > priority {
+			continue
+		}
+		if int(srv.Priority) < priority {
+			records = nil
+		}
+		priority = int(srv.Priority)
+		records = append(records, srvRecord{name: strings.TrimSuffix(srv.Target.String(), "."), port: srv.Port})
+	}
+	if len(records) == 0 {
+		return nil, 0, fmt.Errorf("no SRV records found for %s", name)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].name < records[j].name })
+
+	for i := range records {
+		for _, additional := range msg.Additionals {
+			if ip := resourceIP(additional); ip != nil && strings.TrimSuffix(additional.Header.Name.String(), ".") == records[i].name {
+				records[i].ips = append(records[i].ips, ip)
+				ttl = minTTL(ttl, additional.Header.TTL)
+			}
+		}
+		if records[i].ips != nil {
+			continue
+		}
+		// The targets of SRV records are fully qualified.
+		ips, ipTTL, err := c.lookupIPs(records[i].name + ".")
+		if err != nil {
+			return nil, 0, err
+		}
+		records[i].ips = ips
+		ttl = minTTL(ttl, uint32(ipTTL/time.Second))
+	}
+	return records, time.Duration(ttl) * time.Second, nil
+}
+
+// query sends a query for name to the name servers in turn until one of
+// them answers. Truncated answers are queried again over TCP.
+func (c *dnsClient) query(name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	question, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host name %q: %v", name, err)
+	}
+	id := uint16(rand.Intn(1 << 16))
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: question, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, server := range c.servers {
+		msg, err := c.exchange("udp", server, query, id)
+		if err == nil && msg.Header.Truncated {
+			msg, err = c.exchange("tcp", server, query, id)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		switch msg.Header.RCode {
+		case dnsmessage.RCodeSuccess:
+			return msg, nil
+		case dnsmessage.RCodeNameError:
+			return nil, fmt.Errorf("no such host %s", strings.TrimSuffix(name, "."))
+		default:
+			lastErr = fmt.Errorf("name server %s answered %v for %s", server, msg.Header.RCode, strings.TrimSuffix(name, "."))
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *dnsClient) exchange(network, server string, query []byte, id uint16) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout(network, server, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if network == "tcp" {
+		query = append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	for {
+		var data []byte
+		if network == "tcp" {
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return nil, err
+			}
+			data = make([]byte, int(length[0])<<8|int(length[1]))
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return nil, err
+			}
+		} else {
+			data = make([]byte, 65535)
+			n, err := conn.Read(data)
+			if err != nil {
+				return nil, err
+			}
+			data = data[:n]
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(data); err != nil {
+			return nil, fmt.Errorf("invalid answer of name server %s: %v", server, err)
+		}
+		// Stray answers to earlier queries are skipped.
+		if msg.Header.ID == id && msg.Header.Response {
+			return &msg, nil
+		}
+		if network == "tcp" {
+			return nil, fmt.Errorf("unexpected answer of name server %s", server)
+		}
+	}
+}
+
+func resourceIP(resource dnsmessage.Resource) net.IP {
+	switch body := resource.Body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(body.A[:])
+	case *dnsmessage.AAAAResource:
+		return net.IP(body.AAAA[:])
+	}
+	return nil
+}
+
+func minTTL(ttl, other uint32) uint32 {
+	if other < ttl {
+		return other
+	}
+	return ttl
+}
@@ -0,0 +1,286 @@
+package proxy_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeNameServer answers DNS queries over UDP with the records set by
+// tests.
+type fakeNameServer struct {
+	conn    net.PacketConn
+	mutex   sync.Mutex
+	rcode   dnsmessage.RCode
+	records map[dnsmessage.Type][]dnsmessage.Resource
+	queries int
+}
+
+func newFakeNameServer() *fakeNameServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Ω(err).ShouldNot(HaveOccurred())
+	server := &fakeNameServer{conn: conn, records: map[dnsmessage.Type][]dnsmessage.Resource{}}
+	go server.serve()
+	return server
+}
+
+func (s *fakeNameServer) serve() {
+	data := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(data)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(data[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		s.mutex.Lock()
+		s.queries++
+		answer := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.Header.ID, Response: true, RCode: s.rcode},
+			Questions: query.Questions,
+		}
+		if s.rcode == dnsmessage.RCodeSuccess {
+			answer.Answers = s.records[query.Questions[0].Type]
+		}
+		s.mutex.Unlock()
+		packed, err := answer.Pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(packed, addr)
+	}
+}
+
+func (s *fakeNameServer) set(rcode dnsmessage.RCode, qtype dnsmessage.Type, records ...dnsmessage.Resource) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rcode = rcode
+	s.records[qtype] = records
+}
+
+func (s *fakeNameServer) queryCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queries
+}
+
+func dnsHeader(name string, ttl uint32) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl}
+}
+
+func localAResource(name string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: dnsHeader(name, ttl), Body: &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}}
+}
+
+func srvResource(name string, ttl uint32, priority uint16, target string, server *ghttp.Server) dnsmessage.Resource {
+	serverURL, err := url.Parse(server.URL())
+	Ω(err).ShouldNot(HaveOccurred())
+	port, err := strconv.Atoi(serverURL.Port())
+	Ω(err).ShouldNot(HaveOccurred())
+	return dnsmessage.Resource{
+		Header: dnsHeader(name, ttl),
+		Body:   &dnsmessage.SRVResource{Priority: priority, Port: uint16(port), Target: dnsmessage.MustNewName(target)},
+	}
+}
+
+var _ = Describe("DNS discovery", func() {
+	var nameServer *fakeNameServer
+	var firstServer *ghttp.Server
+	var secondServer *ghttp.Server
+
+	serve := func(handler http.Handler) *httptest.ResponseRecorder {
+		request, err := http.NewRequest("GET", "http://example.com/path", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	// awaitResolution waits until handler sends requests to the resolved
+	// targets and forgets the requests received so far.
+	awaitResolution := func(handler http.Handler) {
+		Eventually(func() int { return serve(handler).Code }).Should(Equal(http.StatusOK))
+		firstServer.Reset()
+		secondServer.Reset()
+	}
+
+	BeforeEach(func() {
+		nameServer = newFakeNameServer()
+		firstServer = ghttp.NewServer()
+		firstServer.AllowUnhandledRequests = true
+		firstServer.UnhandledRequestStatusCode = http.StatusOK
+		secondServer = ghttp.NewServer()
+		secondServer.AllowUnhandledRequests = true
+		secondServer.UnhandledRequestStatusCode = http.StatusOK
+	})
+
+	AfterEach(func() {
+		nameServer.conn.Close()
+		firstServer.Close()
+		secondServer.Close()
+	})
+
+	Context("when resolving addresses", func() {
+		var handler http.Handler
+		var port string
+
+		BeforeEach(func() {
+			serverURL, err := url.Parse(firstServer.URL())
+			Ω(err).ShouldNot(HaveOccurred())
+			port = serverURL.Port()
+			nameServer.set(dnsmessage.RCodeSuccess, dnsmessage.TypeA, localAResource("backend.example.test.", 1))
+
+			handler, err = NewHandlerFromRawConfig([]byte("url: http://backend.example.test:" + port + "/base\n" +
+				"dns_discovery:\n  servers:\n  - " + nameServer.conn.LocalAddr().String() + "\n  refresh_interval: 1h\n  min_refresh_interval: 10ms\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			awaitResolution(handler)
+		})
+
+		It("should send requests to the resolved address with the host name", func() {
+			Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+			Ω(firstServer.ReceivedRequests()).Should(HaveLen(1))
+			request := firstServer.ReceivedRequests()[0]
+			Ω(request.Host).Should(Equal("backend.example.test:" + port))
+			Ω(request.URL.Path).Should(Equal("/base/path"))
+		})
+
+		It("should resolve the name again when the TTL expires", func() {
+			queries := nameServer.queryCount()
+			Eventually(nameServer.queryCount, "3s").Should(BeNumerically(">", queries))
+		})
+
+		It("should keep the last known addresses when resolution fails", func() {
+			nameServer.set(dnsmessage.RCodeServerFailure, dnsmessage.TypeA)
+			queries := nameServer.queryCount()
+			Eventually(nameServer.queryCount, "3s").Should(BeNumerically(">", queries))
+			Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+		})
+
+		It("should stop resolving once the handler is closed", func() {
+			closer, ok := handler.(io.Closer)
+			Ω(ok).Should(BeTrue())
+			Ω(closer.Close()).Should(Succeed())
+			queries := nameServer.queryCount()
+			// A resolution in progress queries A and AAAA records.
+			Consistently(nameServer.queryCount, "1500ms").Should(BeNumerically("<=", queries+2))
+		})
+	})
+
+	Context("when a name can not be resolved at first", func() {
+		It("should send requests to the unresolved URL", func() {
+			serverURL, err := url.Parse(firstServer.URL())
+			Ω(err).ShouldNot(HaveOccurred())
+			nameServer.set(dnsmessage.RCodeServerFailure, dnsmessage.TypeA)
+			handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost:" + serverURL.Port() + "\n" +
+				"dns_discovery:\n  servers:\n  - " + nameServer.conn.LocalAddr().String() + "\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+			Ω(firstServer.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Context("when the name server does not respond", func() {
+		It("should not wait for it before sending requests to the unresolved URL", func() {
+			silentServer, err := net.ListenPacket("udp", "127.0.0.1:0")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer silentServer.Close()
+			serverURL, err := url.Parse(firstServer.URL())
+			Ω(err).ShouldNot(HaveOccurred())
+
+			start := time.Now()
+			handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost:" + serverURL.Port() + "\n" +
+				"dns_discovery:\n  servers:\n  - " + silentServer.LocalAddr().String() + "\n  timeout: 5s\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			defer handler.(io.Closer).Close()
+			Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+			Ω(time.Since(start)).Should(BeNumerically("<", time.Second))
+		})
+	})
+
+	Context("when using the name servers of the system", func() {
+		It("should resolve names of the hosts file", func() {
+			serverURL, err := url.Parse(firstServer.URL())
+			Ω(err).ShouldNot(HaveOccurred())
+			handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost:" + serverURL.Port() + "\ndns_discovery: {}\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+			Ω(firstServer.ReceivedRequests()[0].Host).Should(Equal("localhost:" + serverURL.Port()))
+		})
+	})
+
+	Context("when resolving SRV records", func() {
+		var handler http.Handler
+
+		BeforeEach(func() {
+			nameServer.set(dnsmessage.RCodeSuccess, dnsmessage.TypeA, localAResource("localhost.", 300))
+			nameServer.set(dnsmessage.RCodeSuccess, dnsmessage.TypeSRV,
+				srvResource("_http._tcp.backend.example.test.", 1, 10, "localhost.", firstServer),
+				srvResource("_http._tcp.backend.example.test.", 1, 10, "localhost.", secondServer))
+
+			var err error
+			handler, err = NewHandlerFromRawConfig([]byte("url: http://_http._tcp.backend.example.test\n" +
+				"dns_discovery:\n  srv: true\n  servers:\n  - " + nameServer.conn.LocalAddr().String() + "\n  min_refresh_interval: 10ms\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			awaitResolution(handler)
+		})
+
+		It("should balance requests across the records", func() {
+			for i := 0; i < 4; i++ {
+				Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+			}
+			Ω(firstServer.ReceivedRequests()).Should(HaveLen(2))
+			Ω(secondServer.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should only use the records with the lowest priority", func() {
+			nameServer.set(dnsmessage.RCodeSuccess, dnsmessage.TypeSRV,
+				srvResource("_http._tcp.backend.example.test.", 1, 20, "localhost.", firstServer),
+				srvResource("_http._tcp.backend.example.test.", 1, 10, "localhost.", secondServer))
+			Eventually(func() int {
+				received := len(firstServer.ReceivedRequests())
+				for i := 0; i < 4; i++ {
+					Ω(serve(handler).Code).Should(Equal(http.StatusOK))
+				}
+				return len(firstServer.ReceivedRequests()) - received
+			}, "3s").Should(BeZero())
+		})
+	})
+})
+
+var _ = Describe("DNS discovery configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte(config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail without url and targets", func() {
+		itShouldFail("dns_discovery:\n  refresh_interval: 10s\n")
+	})
+
+	It("should fail on negative refresh interval", func() {
+		itShouldFail("url: http://localhost\ndns_discovery:\n  refresh_interval: -1s\n")
+	})
+
+	It("should fail on egress proxies", func() {
+		itShouldFail("url: http://localhost\ndns_discovery: {}\negress_proxy:\n  url: http://proxy:3128\n")
+	})
+
+	It("should fail on SRV names with port", func() {
+		itShouldFail("url: http://_http._tcp.localhost:8080\ndns_discovery:\n  srv: true\n")
+	})
+})
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var egressProxySchemes = map[string]bool{"http": true, "https": true, "socks5": true, "socks5h": true}
+
+type egressProxyConfig struct {
+	URL      string   `yaml:"url"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	NoProxy  []string `yaml:"no_proxy"`
+}
+
+// egressProxy selects the proxy of upstream requests. Requests to hosts
+// matching a no_proxy rule and to unix sockets are sent directly.
+type egressProxy struct {
+	url     *url.URL
+	noProxy []noProxyRule
+}
+
+func (cfg egressProxyConfig) validate(p *configProblems, path string) {
+	if proxyURL, err := url.Parse(cfg.URL); err != nil {
+		p.add(path+".url", "%v", err)
+	} else if !egressProxySchemes[proxyURL.Scheme] || proxyURL.Host == "" {
+		p.add(path+".url", "must be an http, https, socks5 or socks5h URL with host")
+	}
+	if cfg.Username == "" && cfg.Password != "" {
+		p.add(path+".password", "requires a username")
+	}
+	for i, entry := range cfg.NoProxy {
+		if _, err := parseNoProxyRule(entry); err != nil {
+			p.add(fmt.Sprintf("%s.no_proxy[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+func newEgressProxy(cfg egressProxyConfig) (*egressProxy, error) {
+	proxyURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress_proxy url: %v", err)
+	}
+	if cfg.Username != "" {
+		proxyURL.User = url.UserPassword(cfg.Username, cfg.Password)
+	}
+
+	p := &egressProxy{url: proxyURL}
+	for _, entry := range cfg.NoProxy {
+		rule, err := parseNoProxyRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		p.noProxy = append(p.noProxy, rule)
+	}
+	return p, nil
+}
+
+// proxyFor returns the proxy URL of req for http.Transport.Proxy. HTTP
+// proxies are sent https requests with CONNECT and http requests with an
+// absolute URL, and the credentials of the URL are used to authenticate.
+func (p *egressProxy) proxyFor(req *http.Request) (*url.URL, error) {
+	if _, ok := unixSocketOf(req.URL.Host); ok {
+		return nil, nil
+	}
+	host, port := strings.ToLower(req.URL.Hostname()), req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	for _, rule := range p.noProxy {
+		if rule.matches(host, port) {
+			return nil, nil
+		}
+	}
+	return p.url, nil
+}
+
+// noProxyRule matches the upstream hosts that are not proxied. It is
+// either *, an IP address, an IP network in CIDR notation or a domain
+// name, which matches its subdomains and, unless it starts with a dot,
+// itself. IP addresses and domain names may have a port.
+type noProxyRule struct {
+	all     bool
+	network *net.IPNet
+	ip      net.IP
+	domain  string
+	port    string
+}
+
+func parseNoProxyRule(entry string) (noProxyRule, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	switch {
+	case entry == "":
+		return noProxyRule{}, fmt.Errorf("must not be empty")
+	case entry == "*":
+		return noProxyRule{all: true}, nil
+	}
+	if _, network, err := net.ParseCIDR(entry); err == nil {
+		return noProxyRule{network: network}, nil
+	}
+	rule := noProxyRule{}
+	host := entry
+	if h, port, err := net.SplitHostPort(entry); err == nil {
+		host, rule.port = h, port
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		rule.ip = ip
+	} else {
+		rule.domain = strings.TrimPrefix(host, "*")
+	}
+	return rule, nil
+}
+
+func (r noProxyRule) matches(host, port string) bool {
+	if r.all {
+		return true
+	}
+	if r.port != "" && r.port != port {
+		return false
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case r.network != nil:
+		return ip != nil && r.network.Contains(ip)
+	case r.ip != nil:
+		return ip != nil && r.ip.Equal(ip)
+	case strings.HasPrefix(r.domain, "."):
+		return strings.HasSuffix(host, r.domain)
+	default:
+		return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+	}
+}
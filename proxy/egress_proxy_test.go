@@ -0,0 +1,218 @@
+package proxy_test
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+// fakeSOCKS5Server accepts SOCKS5 connections with username and password
+// authentication and records the addresses they connect to.
+type fakeSOCKS5Server struct {
+	listener net.Listener
+	username string
+	password string
+	targets  chan string
+}
+
+func newFakeSOCKS5Server(username, password string) *fakeSOCKS5Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Ω(err).ShouldNot(HaveOccurred())
+	s := &fakeSOCKS5Server{listener: listener, username: username, password: password, targets: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSOCKS5Server) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	io.ReadFull(conn, methods)
+	conn.Write([]byte{5, 2})
+
+	version := make([]byte, 2)
+	io.ReadFull(conn, version)
+	username := make([]byte, version[1])
+	io.ReadFull(conn, username)
+	length := make([]byte, 1)
+	io.ReadFull(conn, length)
+	password := make([]byte, length[0])
+	io.ReadFull(conn, password)
+	if string(username) != s.username || string(password) != s.password {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	request := make([]byte, 4)
+	io.ReadFull(conn, request)
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	s.targets <- target
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func (s *fakeSOCKS5Server) Close() {
+	s.listener.Close()
+}
+
+var _ = Describe("Egress proxy", func() {
+	var upstream *ghttp.Server
+	var egress *ghttp.Server
+
+	serve := func(handler http.Handler) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/path", nil))
+		return recorder
+	}
+
+	basicAuth := func(username, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	BeforeEach(func() {
+		upstream = ghttp.NewServer()
+		egress = ghttp.NewServer()
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+		egress.Close()
+	})
+
+	It("should send http requests through the HTTP proxy with credentials", func() {
+		egress.AppendHandlers(ghttp.CombineHandlers(
+			func(w http.ResponseWriter, req *http.Request) {
+				Ω(req.URL.String()).Should(Equal(upstream.URL() + "/path"))
+			},
+			ghttp.VerifyHeaderKV("Proxy-Authorization", basicAuth("user", "secret")),
+			ghttp.RespondWith(http.StatusOK, "proxied"),
+		))
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL() + "\negress_proxy:\n  url: " + egress.URL() + "\n  username: user\n  password: secret\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		recorder := serve(handler)
+		Ω(recorder.Code).Should(Equal(http.StatusOK))
+		Ω(recorder.Body.String()).Should(Equal("proxied"))
+		Ω(upstream.ReceivedRequests()).Should(BeEmpty())
+	})
+
+	It("should tunnel https requests through the HTTP proxy with CONNECT", func() {
+		egress.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("CONNECT", ""),
+			ghttp.VerifyHeaderKV("Proxy-Authorization", basicAuth("user", "secret")),
+			func(w http.ResponseWriter, req *http.Request) {
+				Ω(req.Host).Should(Equal("backend.example.com:443"))
+			},
+			ghttp.RespondWith(http.StatusForbidden, nil),
+		))
+		handler, err := NewHandlerFromRawConfig([]byte("url: https://backend.example.com\negress_proxy:\n  url: http://user:secret@" + egress.Addr() + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(serve(handler).Code).Should(Equal(http.StatusBadGateway))
+		Ω(egress.ReceivedRequests()).Should(HaveLen(1))
+	})
+
+	It("should send requests through the SOCKS5 proxy with credentials", func() {
+		socks := newFakeSOCKS5Server("user", "secret")
+		defer socks.Close()
+		upstream.AppendHandlers(ghttp.RespondWith(http.StatusOK, "direct"))
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL() + "\negress_proxy:\n  url: socks5://" + socks.listener.Addr().String() + "\n  username: user\n  password: secret\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		recorder := serve(handler)
+		Ω(recorder.Code).Should(Equal(http.StatusOK))
+		Ω(recorder.Body.String()).Should(Equal("direct"))
+		Ω(socks.targets).Should(Receive(Equal(upstream.Addr())))
+	})
+
+	It("should fail if the SOCKS5 proxy rejects the credentials", func() {
+		socks := newFakeSOCKS5Server("user", "secret")
+		defer socks.Close()
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL() + "\negress_proxy:\n  url: socks5://" + socks.listener.Addr().String() + "\n  username: user\n  password: wrong\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(serve(handler).Code).Should(Equal(http.StatusBadGateway))
+		Ω(upstream.ReceivedRequests()).Should(BeEmpty())
+	})
+
+	It("should send requests to hosts in the no-proxy list directly", func() {
+		upstream.AppendHandlers(ghttp.RespondWith(http.StatusOK, "direct"))
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL() + "\negress_proxy:\n  url: " + egress.URL() + "\n  no_proxy:\n  - backend.example.com\n  - 127.0.0.0/8\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(serve(handler).Body.String()).Should(Equal("direct"))
+		Ω(egress.ReceivedRequests()).Should(BeEmpty())
+	})
+
+	It("should match no-proxy domains and ports", func() {
+		egress.AppendHandlers(ghttp.RespondWith(http.StatusOK, "proxied"), ghttp.RespondWith(http.StatusOK, "proxied"))
+		upstream.AppendHandlers(ghttp.RespondWith(http.StatusOK, "direct"))
+		_, port, err := net.SplitHostPort(upstream.Addr())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		for _, entry := range []string{".localhost", "127.0.0.1:1"} {
+			handler, err := NewHandlerFromRawConfig([]byte("url: http://127.0.0.1:" + port + "\negress_proxy:\n  url: " + egress.URL() + "\n  no_proxy:\n  - \"" + entry + "\"\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(serve(handler).Body.String()).Should(Equal("proxied"))
+		}
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://127.0.0.1:" + port + "\negress_proxy:\n  url: " + egress.URL() + "\n  no_proxy:\n  - \"127.0.0.1:" + port + "\"\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(serve(handler).Body.String()).Should(Equal("direct"))
+	})
+
+	It("should reject unsupported proxy schemes", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL() + "\negress_proxy:\n  url: ftp://" + egress.Addr() + "\n"))
+		Ω(err).Should(MatchError(ContainSubstring("egress_proxy.url: must be")))
+	})
+
+	It("should reject a password without username", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL() + "\negress_proxy:\n  url: " + egress.URL() + "\n  password: secret\n"))
+		Ω(err).Should(MatchError(ContainSubstring("egress_proxy.password: requires a username")))
+	})
+})
@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+	"text/template"
+
+	"github.com/SAP/gologger"
+)
+
+// Failure classes of proxied requests.
+const (
+	errorClassConnectionRefused    = "connection_refused"
+	errorClassDNSFailure           = "dns_failure"
+	errorClassTimeout              = "timeout"
+	errorClassTLSError             = "tls_error"
+	errorClassRequestBodyTooLarge  = "request_body_too_large"
+	errorClassUploadTooSlow        = "upload_too_slow"
+	errorClassBadRequestBody       = "bad_request_body"
+	errorClassResponseBodyTooLarge = "response_body_too_large"
+	errorClassResponseTimeout      = "response_timeout"
+	errorClassClientCanceled       = "client_canceled"
+	errorClassQueueTimeout         = "connection_queue_timeout"
+	errorClassNoTargetAvailable    = "no_target_available"
+	errorClassNoRoute              = "no_route"
+	errorClassUpstreamError        = "upstream_error"
+)
+
+var defaultErrorStatuses = map[string]int{
+	errorClassConnectionRefused:    http.StatusBadGateway,
+	errorClassDNSFailure:           http.StatusBadGateway,
+	errorClassTimeout:              http.StatusGatewayTimeout,
+	errorClassTLSError:             http.StatusBadGateway,
+	errorClassRequestBodyTooLarge:  http.StatusRequestEntityTooLarge,
+	errorClassUploadTooSlow:        http.StatusRequestTimeout,
+	errorClassBadRequestBody:       http.StatusBadRequest,
+	errorClassResponseBodyTooLarge: http.StatusBadGateway,
+	errorClassResponseTimeout:      http.StatusBadGateway,
+	errorClassClientCanceled:       http.StatusBadGateway,
+	errorClassQueueTimeout:         http.StatusServiceUnavailable,
+	errorClassNoTargetAvailable:    http.StatusBadGateway,
+	errorClassNoRoute:              http.StatusNotFound,
+	errorClassUpstreamError:        http.StatusBadGateway,
+}
+
+var errorMessages = map[string]string{
+	errorClassConnectionRefused:    "The upstream server refused the connection.",
+	errorClassDNSFailure:           "The upstream server could not be resolved.",
+	errorClassTimeout:              "The upstream server did not respond in time.",
+	errorClassTLSError:             "The secure connection to the upstream server failed.",
+	errorClassRequestBodyTooLarge:  "The request body is too large.",
+	errorClassUploadTooSlow:        "The request body was sent too slowly.",
+	errorClassBadRequestBody:       "The request body could not be read.",
+	errorClassResponseBodyTooLarge: "The upstream response is too large.",
+	errorClassResponseTimeout:      "The upstream response was not received in time.",
+	errorClassClientCanceled:       "The request was canceled.",
+	errorClassQueueTimeout:         "Too many requests are waiting for the upstream server.",
+	errorClassNoTargetAvailable:    "No upstream server is available.",
+	errorClassNoRoute:              "No route matches the request.",
+	errorClassUpstreamError:        "The upstream server could not be reached.",
+}
+
+// Formats of error response bodies.
+const (
+	errorFormatJSON  = "json"
+	errorFormatHTML  = "html"
+	errorFormatPlain = "plain"
+)
+
+var errorFormatMediaTypes = map[string][]string{
+	errorFormatJSON:  {"application/problem+json", "application/json"},
+	errorFormatHTML:  {"text/html"},
+	errorFormatPlain: {"text/plain"},
+}
+
+var errorFormatContentTypes = map[string]string{
+	errorFormatJSON:  "application/problem+json",
+	errorFormatHTML:  "text/html; charset=utf-8",
+	errorFormatPlain: "text/plain; charset=utf-8",
+}
+
+var defaultErrorFormats = []string{errorFormatJSON, errorFormatHTML, errorFormatPlain}
+
+var defaultErrorTemplates = map[string]string{
+	errorFormatHTML: `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.StatusText}}</h1>
+<p>{{.Message}}</p>
+<p>Request ID: {{.RequestID}}</p>
+</body>
+</html>
+`,
+	errorFormatPlain: "{{.Status}} {{.StatusText}}: {{.Message}}\nRequest ID: {{.RequestID}}\n",
+}
+
+type errorResponsesConfig struct {
+	Statuses  map[string]int    `yaml:"statuses"`
+	Formats   []string          `yaml:"formats"`
+	Templates map[string]string `yaml:"templates"`
+}
+
+type errorTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+type errorData struct {
+	Status     int
+	StatusText string
+	Class      string
+	Message    string
+	RequestID  string
+	Method     string
+	Path       string
+}
+
+// errorResponder handles the errors of the reverse proxy by classifying
+// them and responding with the status code of their class. Response bodies
+// are only written when formats are configured.
+type errorResponder struct {
+	statuses  map[string]int
+	formats   []string
+	templates map[string]errorTemplate
+}
+
+var defaultErrorResponder = &errorResponder{
+	statuses: defaultErrorStatuses,
+}
+
+func (cfg errorResponsesConfig) validate(p *configProblems, path string) {
+	classes := make([]string, 0, len(cfg.Statuses))
+	for class := range cfg.Statuses {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		status := cfg.Statuses[class]
+		if _, ok := defaultErrorStatuses[class]; !ok {
+			p.add(joinConfigPath(path+".statuses", class), "unknown error class")
+		} else if status < 400 || status > 599 {
+			p.add(joinConfigPath(path+".statuses", class), "invalid status code %d", status)
+		}
+	}
+	for i, format := range cfg.Formats {
+		if _, ok := errorFormatMediaTypes[format]; !ok {
+			p.add(fmt.Sprintf("%s.formats[%d]", path, i), "unknown error response format %q", format)
+		}
+	}
+	formats := make([]string, 0, len(cfg.Templates))
+	for format := range cfg.Templates {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	for _, format := range formats {
+		if _, ok := errorFormatMediaTypes[format]; !ok {
+			p.add(joinConfigPath(path+".templates", format), "unknown error response format")
+		} else if _, err := parseErrorTemplate(format, cfg.Templates[format]); err != nil {
+			p.add(joinConfigPath(path+".templates", format), "%v", err)
+		}
+	}
+}
+
+func newErrorResponder(cfg errorResponsesConfig) (*errorResponder, error) {
+	responder := &errorResponder{
+		statuses:  cfg.Statuses,
+		formats:   cfg.Formats,
+		templates: make(map[string]errorTemplate),
+	}
+	for format := range errorFormatMediaTypes {
+		text, ok := cfg.Templates[format]
+		if !ok {
+			text, ok = defaultErrorTemplates[format]
+		}
+		if !ok {
+			continue
+		}
+		tmpl, err := parseErrorTemplate(format, text)
+		if err != nil {
+			return nil, err
+		}
+		responder.templates[format] = tmpl
+	}
+	return responder, nil
+}
+
+func parseErrorTemplate(format, text string) (errorTemplate, error) {
+	if format == errorFormatHTML {
+		tmpl, err := htmltemplate.New(format).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s error template: %v", format, err)
+		}
+		return tmpl, nil
+	}
+	tmpl, err := template.New(format).Funcs(template.FuncMap{"json": toJSON}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s error template: %v", format, err)
+	}
+	return tmpl, nil
+}
+
+func toJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+// HandleError is meant to be used as ErrorHandler of the reverse proxy.
+func (r *errorResponder) HandleError(w http.ResponseWriter, req *http.Request, err error) {
+	class := classifyError(err)
+	status := r.statuses[class]
+	id := requestID(req)
+	switch class {
+	case errorClassClientCanceled:
+		gologger.Debugf("Request %s was canceled: %v", id, err)
+	case errorClassNoRoute:
+		gologger.Debugf("No route matches request %s %s %s", id, req.Method, req.URL.Path)
+	case errorClassRequestBodyTooLarge, errorClassUploadTooSlow, errorClassBadRequestBody:
+		gologger.Warnf("Rejecting request %s (%s): %v", id, class, err)
+	default:
+		gologger.Errorf("Error proxying request %s (%s): %v", id, class, err)
+	}
+
+	if len(r.formats) == 0 {
+		w.WriteHeader(status)
+		return
+	}
+	r.writeError(w, req, status, errorData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Class:      class,
+		Message:    errorMessages[class],
+		RequestID:  id,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+	})
+}
+
+func (r *errorResponder) writeError(w http.ResponseWriter, req *http.Request, status int, data errorData) {
+	format := negotiateErrorFormat(req.Header.Get("Accept"), r.formats)
+	var body bytes.Buffer
+	if tmpl, ok := r.templates[format]; ok {
+		if err := tmpl.Execute(&body, data); err != nil {
+			gologger.Errorf("Error rendering %s error response for request %s: %v", format, data.RequestID, err)
+			w.WriteHeader(status)
+			return
+		}
+	} else {
+		json.NewEncoder(&body).Encode(problemDetails(data))
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", errorFormatContentTypes[format])
+	header.Set("Content-Length", fmt.Sprint(body.Len()))
+	header.Set("X-Content-Type-Options", "nosniff")
+	if data.RequestID != "" {
+		header.Set(requestIDHeader, data.RequestID)
+	}
+	w.WriteHeader(status)
+	if req.Method != "HEAD" {
+		w.Write(body.Bytes())
+	}
+}
+
+// problemDetails returns the RFC 7807 representation of an error.
+func problemDetails(data errorData) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "about:blank",
+		"title":      data.StatusText,
+		"status":     data.Status,
+		"detail":     data.Message,
+		"instance":   data.Path,
+		"request_id": data.RequestID,
+	}
+}
+
+func negotiateErrorFormat(accept string, formats []string) string {
+	best := formats[0]
+	bestQuality := 0.0
+	for _, format := range formats {
+		for _, mediaType := range errorFormatMediaTypes[format] {
+			if quality := mediaTypeQuality(accept, mediaType); quality > bestQuality {
+				best = format
+				bestQuality = quality
+			}
+		}
+	}
+	return best
+}
+
+// mediaTypeQuality returns the quality value of the most specific media
+// range in accept that matches mediaType.
+func mediaTypeQuality(accept, mediaType string) float64 {
+	quality := 0.0
+	specificity := -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, q := parseQuality(part)
+		mediaRange = strings.ToLower(mediaRange)
+		rangeSpecificity := -1
+		switch {
+		case mediaRange == mediaType:
+			rangeSpecificity = 2
+		case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, mediaRange[:len(mediaRange)-1]):
+			rangeSpecificity = 1
+		case mediaRange == "*/*" || mediaRange == "*":
+			rangeSpecificity = 0
+		}
+		if rangeSpecificity > specificity {
+			specificity = rangeSpecificity
+			quality = q
+		}
+	}
+	return quality
+}
+
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	var tooLarge *http.MaxBytesError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &tooLarge):
+		return errorClassRequestBodyTooLarge
+	case errors.Is(err, errUploadTooSlow):
+		return errorClassUploadTooSlow
+	case errors.Is(err, errRequestBodyUnreadable):
+		return errorClassBadRequestBody
+	case errors.Is(err, errResponseBodyTooLarge):
+		return errorClassResponseBodyTooLarge
+	case errors.Is(err, errResponseReadTimeout):
+		return errorClassResponseTimeout
+	case errors.Is(err, errConnectionQueueTimeout):
+		return errorClassQueueTimeout
+	case errors.Is(err, errNoTargetAvailable):
+		return errorClassNoTargetAvailable
+	case errors.Is(err, errNoRoute):
+		return errorClassNoRoute
+	case errors.Is(err, context.Canceled):
+		return errorClassClientCanceled
+	case errors.As(err, &dnsErr):
+		return errorClassDNSFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorClassConnectionRefused
+	case isTLSError(err):
+		return errorClassTLSError
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errorClassTimeout
+	}
+	return errorClassUpstreamError
+}
+
+func isTLSError(err error) bool {
+	var recordHeaderErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordHeaderErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
+
+// proxyErrorLog routes the log messages of the reverse proxy through
+// gologger.
+var proxyErrorLog = log.New(errorLogWriter{}, "", 0)
+
+type errorLogWriter struct{}
+
+func (errorLogWriter) Write(data []byte) (int, error) {
+	gologger.Errorf("%s", strings.TrimSuffix(string(data), "\n"))
+	return len(data), nil
+}
@@ -0,0 +1,125 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Error responses", func() {
+	const requestID = "some-request-id"
+
+	var unreachableURL string
+	var config string
+	var request *http.Request
+	var response *httptest.ResponseRecorder
+
+	BeforeEach(func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		unreachableURL = server.URL
+		server.Close()
+
+		response = httptest.NewRecorder()
+		var err error
+		request, err = http.NewRequest("GET", "http://example.com/resource", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		request.Header.Set("X-Aker-Request-Id", requestID)
+	})
+
+	JustBeforeEach(func() {
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + unreachableURL + "\n" + config))
+		Ω(err).ShouldNot(HaveOccurred())
+		handler.ServeHTTP(response, request)
+	})
+
+	Context("when error responses are not configured", func() {
+		BeforeEach(func() {
+			config = ""
+		})
+
+		It("should respond with a bare 502", func() {
+			Ω(response.Code).Should(Equal(http.StatusBadGateway))
+			Ω(response.Body.String()).Should(BeEmpty())
+		})
+	})
+
+	Context("when error responses are configured", func() {
+		BeforeEach(func() {
+			config = "error_responses:\n  statuses:\n    connection_refused: 503\n"
+		})
+
+		It("should respond with the configured status and a problem document", func() {
+			Ω(response.Code).Should(Equal(http.StatusServiceUnavailable))
+			Ω(response.Header().Get("Content-Type")).Should(Equal("application/problem+json"))
+			Ω(response.Header().Get("X-Aker-Request-Id")).Should(Equal(requestID))
+
+			var problem map[string]interface{}
+			Ω(json.Unmarshal(response.Body.Bytes(), &problem)).Should(Succeed())
+			Ω(problem).Should(HaveKeyWithValue("status", BeNumerically("==", 503)))
+			Ω(problem).Should(HaveKeyWithValue("title", "Service Unavailable"))
+			Ω(problem).Should(HaveKeyWithValue("request_id", requestID))
+		})
+
+		Context("and the client accepts HTML", func() {
+			BeforeEach(func() {
+				request.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+			})
+
+			It("should respond with HTML", func() {
+				Ω(response.Header().Get("Content-Type")).Should(Equal("text/html; charset=utf-8"))
+				Ω(response.Body.String()).Should(ContainSubstring("Request ID: " + requestID))
+			})
+		})
+
+		Context("and the client accepts plain text only", func() {
+			BeforeEach(func() {
+				request.Header.Set("Accept", "text/plain")
+			})
+
+			It("should respond with plain text", func() {
+				Ω(response.Header().Get("Content-Type")).Should(Equal("text/plain; charset=utf-8"))
+				Ω(response.Body.String()).Should(HavePrefix("503 Service Unavailable"))
+			})
+		})
+	})
+
+	Context("when a custom template is configured", func() {
+		BeforeEach(func() {
+			config = "error_responses:\n  formats: [plain]\n  templates:\n    plain: \"{{.Class}} {{.RequestID}}\"\n"
+		})
+
+		It("should render the template", func() {
+			Ω(response.Code).Should(Equal(http.StatusBadGateway))
+			Ω(response.Body.String()).Should(Equal("connection_refused " + requestID))
+		})
+	})
+})
+
+var _ = Describe("Error responses configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost\nerror_responses:\n" + config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail on unknown error class", func() {
+		itShouldFail("  statuses:\n    unknown: 500\n")
+	})
+
+	It("should fail on invalid status code", func() {
+		itShouldFail("  statuses:\n    timeout: 200\n")
+	})
+
+	It("should fail on unknown format", func() {
+		itShouldFail("  formats: [xml]\n")
+	})
+
+	It("should fail on invalid template", func() {
+		itShouldFail("  templates:\n    html: \"{{.Status\"\n")
+	})
+})
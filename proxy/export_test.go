@@ -0,0 +1,12 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+)
+
+// ReloadSignals returns the channel on which handler, which must have been
+// created with config_file, receives SIGHUP.
+func ReloadSignals(handler http.Handler) <-chan os.Signal {
+	return handler.(*reloadingHandler).signals
+}
@@ -6,8 +6,6 @@ import (
 	"net/url"
 	"strings"
 	"time"
-
-	"github.com/SAP/aker/plugin"
 )
 
 type handlerConfig struct {
@@ -15,29 +13,298 @@ type handlerConfig struct {
 	ProxyPath               string        `yaml:"proxy_path"`
 	PreserveInternalHeaders bool          `yaml:"preserve_internal_headers"`
 	FlushInterval           time.Duration `yaml:"flush_interval"`
+
+	MaxRequestBodyBytes int64         `yaml:"max_request_body_bytes"`
+	MinUploadRate       int64         `yaml:"min_upload_rate"`
+	UploadGracePeriod   time.Duration `yaml:"upload_grace_period"`
+	BufferRequests      bool          `yaml:"buffer_requests"`
+
+	MaxResponseBodyBytes int64         `yaml:"max_response_body_bytes"`
+	ResponseReadTimeout  time.Duration `yaml:"response_read_timeout"`
+	ResponseBufferBytes  int64         `yaml:"response_buffer_bytes"`
+
+	Compression     *compressionConfig    `yaml:"compression"`
+	ErrorResponses  *errorResponsesConfig `yaml:"error_responses"`
+	InterceptErrors []interceptRuleConfig `yaml:"intercept_errors"`
+	Metrics         *metricsConfig        `yaml:"metrics"`
+	Tracing         *tracingConfig        `yaml:"tracing"`
+	AccessLog       *accessLogConfig      `yaml:"access_log"`
+	DebugCapture    *debugCaptureConfig   `yaml:"debug_capture"`
+	Routes          []routeConfig         `yaml:"routes"`
+	Canary          *canaryConfig         `yaml:"canary"`
+	Mirror          *mirrorConfig         `yaml:"mirror"`
+	Targets         []string              `yaml:"targets"`
+	StickySessions  *stickySessionsConfig `yaml:"sticky_sessions"`
+	Health          *healthConfig         `yaml:"health"`
+	LoadBalancing   *loadBalancingConfig  `yaml:"load_balancing"`
+	ConfigFile      *configFileConfig     `yaml:"config_file"`
+	DNSDiscovery    *dnsDiscoveryConfig   `yaml:"dns_discovery"`
+	TargetsFile     *targetsFileConfig    `yaml:"targets_file"`
+	ConnectionPool  *connectionPoolConfig `yaml:"connection_pool"`
+	EgressProxy     *egressProxyConfig    `yaml:"egress_proxy"`
+
+	secrets secretValues
 }
 
 func NewHandlerFromRawConfig(config []byte) (http.Handler, error) {
-	cfg := handlerConfig{}
-	if err := plugin.UnmarshalConfig(config, &cfg); err != nil {
+	cfg, err := unmarshalHandlerConfig(config)
+	if err != nil {
 		return nil, err
 	}
 	return NewHandlerFromConfig(cfg)
 }
 
+// NewHandlerFromConfig returns the handler of cfg. Handlers that hold files
+// or run background tasks implement io.Closer, which releases them.
 func NewHandlerFromConfig(cfg handlerConfig) (http.Handler, error) {
+	if err := validateConfig(cfg).err(); err != nil {
+		return nil, cfg.secrets.redact(err)
+	}
+	if cfg.ConfigFile != nil {
+		return newReloadingHandler(cfg)
+	}
+	handler, resources, err := newHandler(cfg)
+	if err != nil {
+		return nil, cfg.secrets.redact(err)
+	}
+	if resources.inUse() {
+		return &releasingHandler{Handler: handler, resources: resources}, nil
+	}
+	return handler, nil
+}
+
+// newHandler returns the handler of cfg and its resources, which are to be
+// released once the handler is no longer used.
+func newHandler(cfg handlerConfig) (_ http.Handler, _ *handlerResources, err error) {
+	cfg = withDefaults(cfg)
+	resources := newHandlerResources()
+	defer func() {
+		if err != nil {
+			resources.release()
+		}
+	}()
+
 	targetURL, err := url.Parse(cfg.URL)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	targetURL = resolveUnixSocketURL(targetURL)
+
+	proxy := newReverseProxy(targetURL, cfg.ProxyPath, cfg.PreserveInternalHeaders, cfg.FlushInterval)
+	var handler http.Handler = proxy
+	var modifiers []func(*http.Response) error
+	var transport http.RoundTripper = upstreamTransport
+
+	if cfg.ErrorResponses != nil {
+		responder, err := newErrorResponder(*cfg.ErrorResponses)
+		if err != nil {
+			return nil, nil, err
+		}
+		proxy.ErrorHandler = responder.HandleError
+	}
+
+	var connections *connectionPool
+	if cfg.ConnectionPool != nil {
+		if connections, err = newConnectionPool(*cfg.ConnectionPool); err != nil {
+			return nil, nil, err
+		}
+		closeIdleConnectionsOnStop(connections.transport, resources.stopped())
+		transport = connections.transport
+	}
+	if cfg.EgressProxy != nil {
+		egress, err := newEgressProxy(*cfg.EgressProxy)
+		if err != nil {
+			return nil, nil, err
+		}
+		var base *http.Transport
+		if connections != nil {
+			base = connections.transport
+		} else {
+			base = newUpstreamTransport()
+			closeIdleConnectionsOnStop(base, resources.stopped())
+		}
+		base.Proxy = egress.proxyFor
+		transport = base
+	}
+
+	targets := cfg.Targets
+	var targetsFileContents []byte
+	if cfg.TargetsFile != nil {
+		if targets, targetsFileContents, err = readTargetsFile(cfg.TargetsFile.Path); err != nil {
+			return nil, nil, err
+		}
+	}
+	if cfg.DNSDiscovery != nil && cfg.URL != "" {
+		targets = []string{cfg.URL}
+	}
+	if len(targets) > 0 {
+		affinity, err := newSessionAffinity(cfg.StickySessions)
+		if err != nil {
+			return nil, nil, err
+		}
+		balancer, err := newHashBalancer(cfg.LoadBalancing)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool, err := newTargetPool(targets, cfg.Health, affinity, balancer)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cfg.DNSDiscovery != nil {
+			discoverTargets(cfg.DNSDiscovery, pool, resources.stopped())
+			pool.closeTransportsOnStop(resources.stopped())
+		}
+		if cfg.TargetsFile != nil {
+			if err := watchTargetsFile(cfg.TargetsFile, pool, targetsFileContents, resources.stopped()); err != nil {
+				return nil, nil, err
+			}
+		}
+		pool.handleError = proxy.ErrorHandler
+		handler = pool.Wrap(handler)
+		transport = pool.WrapTransport(transport)
+	}
+	if connections != nil {
+		transport = connections.WrapTransport(transport)
+	}
+
+	router, err := newRouter(cfg.Routes, len(targets) > 0 || cfg.URL != "")
+	if err != nil {
+		return nil, nil, err
+	}
+	defaultCanary, err := newCanary(cfg.Canary)
+	if err != nil {
+		return nil, nil, err
+	}
+	if defaultCanary != nil || router.hasCanaries() {
+		handler = splitTraffic(handler, defaultCanary)
+	}
+	if len(cfg.Routes) > 0 {
+		router.handleError = proxy.ErrorHandler
+		handler = router.Wrap(handler)
+	}
+
+	if len(cfg.InterceptErrors) > 0 {
+		rules, err := newInterceptRules(cfg.InterceptErrors)
+		if err != nil {
+			return nil, nil, err
+		}
+		modifiers = append(modifiers, interceptResponses(rules))
+	}
+
+	responseLimiter, err := newResponseLimiter(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if responseLimiter.enabled() {
+		modifiers = append(modifiers, responseLimiter.LimitResponse)
+	}
+
+	if cfg.Compression != nil {
+		compressor, err := newCompressor(*cfg.Compression)
+		if err != nil {
+			return nil, nil, err
+		}
+		if compressor.decompress {
+			modifiers = append(modifiers, compressor.DecompressResponse)
+		}
+		handler = compressor.Wrap(handler)
+	}
+
+	limiter, err := newRequestLimiter(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if limiter.enabled() {
+		limiter.handleError = proxy.ErrorHandler
+		handler = limiter.Wrap(handler)
+	}
+
+	var metrics *proxyMetrics
+	if cfg.Metrics != nil {
+		metrics, err = serveMetrics(*cfg.Metrics)
+		if err != nil {
+			return nil, nil, err
+		}
+		if connections != nil {
+			connections.metrics = metrics
+		}
+	}
+
+	if cfg.Mirror != nil {
+		mirror, err := newMirror(*cfg.Mirror)
+		if err != nil {
+			return nil, nil, err
+		}
+		if mirror.comparer != nil {
+			mirror.comparer.metrics = metrics
+		}
+		transport = mirror.WrapTransport(transport)
+	}
+
+	if cfg.DebugCapture != nil {
+		capture, err := newDebugCapture(*cfg.DebugCapture)
+		if err != nil {
+			return nil, nil, err
+		}
+		resources.closeOnRelease(capture.output)
+		transport = capture.WrapTransport(transport)
+		handler = capture.Wrap(handler)
+	}
+
+	if cfg.Tracing != nil {
+		tracer, err := newTracer(*cfg.Tracing, resources.stopped())
+		if err != nil {
+			return nil, nil, err
+		}
+		transport = tracer.WrapTransport(transport)
+	}
+
+	if metrics != nil {
+		transport = metrics.WrapTransport(transport)
+		handler = metrics.Wrap(handler)
+	}
+
+	if cfg.AccessLog != nil {
+		accessLogger, err := newAccessLogger(*cfg.AccessLog)
+		if err != nil {
+			return nil, nil, err
+		}
+		resources.closeOnRelease(accessLogger.output)
+		handler = accessLogger.Wrap(handler)
+	}
+
+	if cfg.Metrics != nil || cfg.AccessLog != nil {
+		transport = trackRequestInfo(transport)
 	}
 
-	return NewHandler(targetURL, cfg.ProxyPath, cfg.PreserveInternalHeaders, cfg.FlushInterval), nil
+	if len(modifiers) > 0 {
+		proxy.ModifyResponse = chainResponseModifiers(modifiers)
+	}
+	proxy.Transport = transport
+	return handler, resources, nil
 }
 
 func NewHandler(targetURL *url.URL, proxyPath string, preserveHeaders bool, flushInterval time.Duration) http.Handler {
+	return newReverseProxy(resolveUnixSocketURL(targetURL), proxyPath, preserveHeaders, flushInterval)
+}
+
+func newReverseProxy(targetURL *url.URL, proxyPath string, preserveHeaders bool, flushInterval time.Duration) *httputil.ReverseProxy {
 	return &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			req.Host = targetURL.Host
+			rememberRequestID(req)
+			targetURL, proxyPath, host := targetURL, proxyPath, ""
+			if route := routeOf(req); route != nil {
+				targetURL, proxyPath = route.target, route.ProxyPath
+			} else if target := poolTargetOf(req); target != nil {
+				targetURL, host = target.url, target.host
+			}
+			if canaryTarget := canaryTargetOf(req); canaryTarget != nil {
+				targetURL, host = canaryTarget, ""
+			}
+			if host == "" {
+				host = upstreamHost(targetURL)
+			}
+			req.Host = host
 			req.URL.Scheme = targetURL.Scheme
 			req.URL.Host = targetURL.Host
 			originalPath := removeProxyPath(req.URL.Path, proxyPath)
@@ -46,7 +313,21 @@ func NewHandler(targetURL *url.URL, proxyPath string, preserveHeaders bool, flus
 				removeInternalHeaders(req.Header)
 			}
 		},
+		Transport:     upstreamTransport,
 		FlushInterval: flushInterval,
+		ErrorHandler:  defaultErrorResponder.HandleError,
+		ErrorLog:      proxyErrorLog,
+	}
+}
+
+func chainResponseModifiers(modifiers []func(*http.Response) error) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for _, modify := range modifiers {
+			if err := modify(resp); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 }
 
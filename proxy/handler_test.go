@@ -28,7 +28,7 @@ var _ = Describe("Handler", func() {
 			}
 
 			It("should be able to parse flush interval", func() {
-				config = []byte("flush_interval: 300ms")
+				config = []byte("url: http://localhost:8080/\nflush_interval: 300ms")
 				itShouldCreateValidProxyHandlerFromRawConfig()
 				Ω(proxyHandler.FlushInterval).Should(Equal(300 * time.Millisecond))
 			})
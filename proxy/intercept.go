@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultInterceptContentType = "text/html; charset=utf-8"
+
+type interceptRuleConfig struct {
+	Statuses     []string `yaml:"statuses"`
+	ContentTypes []string `yaml:"content_types"`
+	Status       int      `yaml:"status"`
+	Template     string   `yaml:"template"`
+	File         string   `yaml:"file"`
+	ContentType  string   `yaml:"content_type"`
+}
+
+type interceptData struct {
+	Status         int
+	StatusText     string
+	UpstreamStatus int
+	RequestID      string
+	Method         string
+	Path           string
+}
+
+// interceptRule replaces the body of upstream responses with matching status
+// code and content type.
+type interceptRule struct {
+	statuses     []statusMatcher
+	contentTypes []string
+	status       int
+	template     errorTemplate
+	content      []byte
+	contentType  string
+}
+
+// statusMatcher matches either a single status code or, when class is set,
+// all status codes of a class such as 5xx.
+type statusMatcher struct {
+	status int
+	class  int
+}
+
+func (m statusMatcher) matches(status int) bool {
+	if m.class != 0 {
+		return status/100 == m.class
+	}
+	return status == m.status
+}
+
+func parseStatusMatcher(value string) (statusMatcher, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if len(value) == 3 && strings.HasSuffix(value, "xx") && value[0] >= '1' && value[0] <= '5' {
+		return statusMatcher{class: int(value[0] - '0')}, nil
+	}
+	status, err := strconv.Atoi(value)
+	if err != nil || status < 100 || status > 599 {
+		return statusMatcher{}, fmt.Errorf("invalid status code: %q", value)
+	}
+	return statusMatcher{status: status}, nil
+}
+
+func (cfg interceptRuleConfig) validate(p *configProblems, path string) {
+	if len(cfg.Statuses) == 0 {
+		p.add(path+".statuses", "must not be empty")
+	}
+	for i, value := range cfg.Statuses {
+		if _, err := parseStatusMatcher(value); err != nil {
+			p.add(fmt.Sprintf("%s.statuses[%d]", path, i), "%v", err)
+		}
+	}
+	if (cfg.Template == "") == (cfg.File == "") {
+		p.add(path, "exactly one of template and file must be set")
+	}
+	if cfg.Status != 0 && (cfg.Status < 100 || cfg.Status > 599) {
+		p.add(path+".status", "invalid status code %d", cfg.Status)
+	}
+	if cfg.Template != "" {
+		if _, err := parseErrorTemplate(cfg.templateFormat(), cfg.Template); err != nil {
+			p.add(path+".template", "%v", err)
+		}
+	}
+}
+
+// contentType returns the content type of the responses of the rule.
+func (cfg interceptRuleConfig) contentType() string {
+	contentType := cfg.ContentType
+	if contentType == "" && cfg.File != "" {
+		contentType = mime.TypeByExtension(filepath.Ext(cfg.File))
+	}
+	if contentType == "" {
+		contentType = defaultInterceptContentType
+	}
+	return contentType
+}
+
+// templateFormat returns the format the template of the rule is parsed in,
+// which escapes values for HTML content.
+func (cfg interceptRuleConfig) templateFormat() string {
+	if matchesContentType(cfg.contentType(), []string{"text/html"}) {
+		return errorFormatHTML
+	}
+	return errorFormatPlain
+}
+
+func newInterceptRules(cfgs []interceptRuleConfig) ([]*interceptRule, error) {
+	rules := make([]*interceptRule, len(cfgs))
+	for i, cfg := range cfgs {
+		rule, err := newInterceptRule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid intercept_errors rule %d: %v", i, err)
+		}
+		rules[i] = rule
+	}
+	return rules, nil
+}
+
+func newInterceptRule(cfg interceptRuleConfig) (*interceptRule, error) {
+	rule := &interceptRule{
+		contentTypes: cfg.ContentTypes,
+		status:       cfg.Status,
+		contentType:  cfg.contentType(),
+	}
+	for _, value := range cfg.Statuses {
+		matcher, err := parseStatusMatcher(value)
+		if err != nil {
+			return nil, err
+		}
+		rule.statuses = append(rule.statuses, matcher)
+	}
+
+	if cfg.File != "" {
+		content, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		rule.content = content
+	}
+	if cfg.Template != "" {
+		tmpl, err := parseErrorTemplate(cfg.templateFormat(), cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		rule.template = tmpl
+	}
+	return rule, nil
+}
+
+func (r *interceptRule) matches(resp *http.Response) bool {
+	if len(r.contentTypes) > 0 && !matchesContentType(resp.Header.Get("Content-Type"), r.contentTypes) {
+		return false
+	}
+	for _, matcher := range r.statuses {
+		if matcher.matches(resp.StatusCode) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *interceptRule) replace(resp *http.Response) error {
+	status := resp.StatusCode
+	if r.status != 0 {
+		status = r.status
+	}
+
+	content := r.content
+	if r.template != nil {
+		var body bytes.Buffer
+		err := r.template.Execute(&body, interceptData{
+			Status:         status,
+			StatusText:     http.StatusText(status),
+			UpstreamStatus: resp.StatusCode,
+			RequestID:      requestID(resp.Request),
+			Method:         resp.Request.Method,
+			Path:           resp.Request.URL.Path,
+		})
+		if err != nil {
+			return fmt.Errorf("error rendering intercepted response: %v", err)
+		}
+		content = body.Bytes()
+	}
+
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(content))
+	resp.ContentLength = int64(len(content))
+	resp.TransferEncoding = nil
+	resp.StatusCode = status
+	resp.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	for _, name := range []string{"Content-Encoding", "Content-Range", "ETag", "Last-Modified", "Accept-Ranges"} {
+		resp.Header.Del(name)
+	}
+	resp.Header.Set("Content-Type", r.contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(content)))
+	return nil
+}
+
+// interceptResponses returns a response modifier that applies the first
+// matching rule to upstream responses.
+func interceptResponses(rules []*interceptRule) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for _, rule := range rules {
+			if rule.matches(resp) {
+				return rule.replace(resp)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,129 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Intercepting errors", func() {
+	const stackTrace = "<html>NullPointerException at com.example.Internal</html>"
+
+	var fakeServer *ghttp.Server
+	var config string
+	var request *http.Request
+	var response *httptest.ResponseRecorder
+
+	BeforeEach(func() {
+		fakeServer = ghttp.NewServer()
+		response = httptest.NewRecorder()
+		var err error
+		request, err = http.NewRequest("GET", "http://example.com/", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		request.Header.Set("X-Aker-Request-Id", "some-request-id")
+		fakeServer.AppendHandlers(ghttp.RespondWith(http.StatusInternalServerError, stackTrace, http.Header{
+			"Content-Type": []string{"text/html"},
+		}))
+	})
+
+	AfterEach(func() {
+		fakeServer.Close()
+	})
+
+	JustBeforeEach(func() {
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + fakeServer.URL() + "\n" + config))
+		Ω(err).ShouldNot(HaveOccurred())
+		handler.ServeHTTP(response, request)
+	})
+
+	Context("when a template rule matches", func() {
+		BeforeEach(func() {
+			config = `intercept_errors:
+  - statuses: ["5xx"]
+    status: 503
+    template: "<p>Sorry ({{.UpstreamStatus}}), request {{.RequestID}}</p>"
+`
+		})
+
+		It("should replace the response", func() {
+			Ω(response.Code).Should(Equal(http.StatusServiceUnavailable))
+			Ω(response.Header().Get("Content-Type")).Should(Equal("text/html; charset=utf-8"))
+			Ω(response.Body.String()).Should(Equal("<p>Sorry (500), request some-request-id</p>"))
+		})
+	})
+
+	Context("when a file rule matches", func() {
+		var file *os.File
+
+		BeforeEach(func() {
+			var err error
+			file, err = ioutil.TempFile("", "intercept")
+			Ω(err).ShouldNot(HaveOccurred())
+			file.WriteString("Something went wrong.")
+			file.Close()
+			config = "intercept_errors:\n  - statuses: [500]\n    file: " + file.Name() + "\n    content_type: text/plain\n"
+		})
+
+		AfterEach(func() {
+			os.Remove(file.Name())
+		})
+
+		It("should keep the status and replace the body", func() {
+			Ω(response.Code).Should(Equal(http.StatusInternalServerError))
+			Ω(response.Header().Get("Content-Type")).Should(Equal("text/plain"))
+			Ω(response.Body.String()).Should(Equal("Something went wrong."))
+		})
+	})
+
+	Context("when the content type does not match", func() {
+		BeforeEach(func() {
+			config = "intercept_errors:\n  - statuses: [500]\n    content_types: [application/json]\n    template: replaced\n"
+		})
+
+		It("should pass the response through", func() {
+			Ω(response.Code).Should(Equal(http.StatusInternalServerError))
+			Ω(response.Body.String()).Should(Equal(stackTrace))
+		})
+	})
+
+	Context("when the status does not match", func() {
+		BeforeEach(func() {
+			config = "intercept_errors:\n  - statuses: [502, 4xx]\n    template: replaced\n"
+		})
+
+		It("should pass the response through", func() {
+			Ω(response.Body.String()).Should(Equal(stackTrace))
+		})
+	})
+})
+
+var _ = Describe("Intercepting errors configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost\nintercept_errors:\n" + config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail without statuses", func() {
+		itShouldFail("  - template: replaced\n")
+	})
+
+	It("should fail on invalid status", func() {
+		itShouldFail("  - statuses: [9xx]\n    template: replaced\n")
+	})
+
+	It("should fail when both template and file are set", func() {
+		itShouldFail("  - statuses: [500]\n    template: replaced\n    file: /some/file\n")
+	})
+
+	It("should fail when the file does not exist", func() {
+		itShouldFail("  - statuses: [500]\n    file: /does/not/exist\n")
+	})
+})
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	referenceStart   = "${"
+	fileReference    = "file:"
+	defaultSeparator = ":-"
+	redacted         = "<redacted>"
+)
+
+var environmentVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// secretValues holds the values that references in a configuration
+// resolved to. They must not appear in logs or validation output.
+type secretValues []string
+
+// redact returns err with the secret values replaced.
+func (s secretValues) redact(err error) error {
+	if err == nil || len(s) == 0 {
+		return err
+	}
+	if problems, ok := err.(configProblems); ok {
+		redactedProblems := make(configProblems, len(problems))
+		for i, problem := range problems {
+			redactedProblems[i] = s.redactString(problem)
+		}
+		return redactedProblems
+	}
+	return errors.New(s.redactString(err.Error()))
+}
+
+func (s secretValues) redactString(value string) string {
+	// Longer values first, so that a value containing another one is
+	// replaced as a whole.
+	values := append(secretValues(nil), s...)
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	for _, secret := range values {
+		value = strings.Replace(value, secret, redacted, -1)
+	}
+	return value
+}
+
+// interpolate returns a copy of the YAML document with the references in
+// its string values resolved, together with the values they resolved to.
+// A reference is either ${NAME}, ${NAME:-default} or ${file:/path}, and
+// $${ stands for a literal ${.
+func (p *configProblems) interpolate(document interface{}, path string, secrets *secretValues) interface{} {
+	switch value := document.(type) {
+	case map[interface{}]interface{}:
+		interpolated := make(map[interface{}]interface{}, len(value))
+		for key, item := range value {
+			interpolated[key] = p.interpolate(item, joinConfigPath(path, fmt.Sprint(key)), secrets)
+		}
+		return interpolated
+	case []interface{}:
+		interpolated := make([]interface{}, len(value))
+		for i, item := range value {
+			interpolated[i] = p.interpolate(item, fmt.Sprintf("%s[%d]", path, i), secrets)
+		}
+		return interpolated
+	case string:
+		interpolated, err := expandReferences(value, secrets)
+		if err != nil {
+			p.add(path, "%v", err)
+		}
+		return interpolated
+	default:
+		return value
+	}
+}
+
+func expandReferences(value string, secrets *secretValues) (string, error) {
+	var expanded []string
+	for {
+		start := strings.Index(value, referenceStart)
+		if start < 0 {
+			break
+		}
+		if start > 0 && value[start-1] == '$' {
+			expanded = append(expanded, value[:start-1], referenceStart)
+			value = value[start+len(referenceStart):]
+			continue
+		}
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated reference %s", value[start:])
+		}
+		reference := value[start+len(referenceStart) : start+end]
+		resolved, err := resolveReference(reference, secrets)
+		if err != nil {
+			return "", err
+		}
+		expanded = append(expanded, value[:start], resolved)
+		value = value[start+end+1:]
+	}
+	return strings.Join(append(expanded, value), ""), nil
+}
+
+func resolveReference(reference string, secrets *secretValues) (string, error) {
+	if strings.HasPrefix(reference, fileReference) {
+		path := strings.TrimPrefix(reference, fileReference)
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("cannot read secret file: %v", err)
+		}
+		resolved := strings.TrimRight(string(contents), "\r\n")
+		secrets.add(resolved)
+		return resolved, nil
+	}
+
+	name, defaultValue, hasDefault := reference, "", false
+	if i := strings.Index(reference, defaultSeparator); i >= 0 {
+		name, defaultValue, hasDefault = reference[:i], reference[i+len(defaultSeparator):], true
+	}
+	if !environmentVariableName.MatchString(name) {
+		return "", fmt.Errorf("invalid reference ${%s}", reference)
+	}
+	if resolved := os.Getenv(name); resolved != "" {
+		secrets.add(resolved)
+		return resolved, nil
+	}
+	if !hasDefault {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	secrets.add(defaultValue)
+	return defaultValue, nil
+}
+
+func (s *secretValues) add(value string) {
+	if value != "" {
+		*s = append(*s, value)
+	}
+}
+
+// restoreReferences sets the string values of value that contain references
+// in the YAML document back to the references, so that the resolved values
+// do not appear when value is marshaled.
+func restoreReferences(value reflect.Value, document interface{}) {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			restoreReferences(value.Elem(), document)
+		}
+	case reflect.Struct:
+		properties, _ := document.(map[interface{}]interface{})
+		fields := yamlFields(value.Type())
+		for key, item := range properties {
+			if field, ok := fields[fmt.Sprint(key)]; ok {
+				restoreReferences(value.FieldByIndex(field.Index), item)
+			}
+		}
+	case reflect.Slice:
+		items, _ := document.([]interface{})
+		for i := 0; i < len(items) && i < value.Len(); i++ {
+			restoreReferences(value.Index(i), items[i])
+		}
+	case reflect.Map:
+		entries, _ := document.(map[interface{}]interface{})
+		if value.IsNil() || value.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for key, item := range entries {
+			if reference, ok := item.(string); ok && strings.Contains(reference, referenceStart) {
+				value.SetMapIndex(reflect.ValueOf(fmt.Sprint(key)).Convert(value.Type().Key()), reflect.ValueOf(reference).Convert(value.Type().Elem()))
+			}
+		}
+	case reflect.String:
+		if reference, ok := document.(string); ok && strings.Contains(reference, referenceStart) && value.CanSet() {
+			value.SetString(reference)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Configuration interpolation", func() {
+	var server *ghttp.Server
+	var secretFile string
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		os.Setenv("PROXY_TEST_URL", server.URL())
+		os.Setenv("PROXY_TEST_SECRET", "hunter2")
+
+		file, err := ioutil.TempFile("", "secret")
+		Ω(err).ShouldNot(HaveOccurred())
+		file.WriteString("s3cr3t\n")
+		file.Close()
+		secretFile = file.Name()
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.Unsetenv("PROXY_TEST_URL")
+		os.Unsetenv("PROXY_TEST_SECRET")
+		os.Remove(secretFile)
+	})
+
+	It("should resolve environment variables", func() {
+		server.AppendHandlers(ghttp.VerifyRequest("GET", "/api/path"))
+		handler, err := NewHandlerFromRawConfig([]byte("url: ${PROXY_TEST_URL}/api\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/path", nil))
+		Ω(server.ReceivedRequests()).Should(HaveLen(1))
+	})
+
+	It("should use defaults of unset environment variables", func() {
+		server.AppendHandlers(ghttp.VerifyRequest("GET", "/default/path"))
+		handler, err := NewHandlerFromRawConfig([]byte("url: ${PROXY_TEST_URL}${PROXY_TEST_UNSET:-/default}\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/path", nil))
+		Ω(server.ReceivedRequests()).Should(HaveLen(1))
+	})
+
+	It("should resolve secret files", func() {
+		server.AppendHandlers(ghttp.VerifyRequest("GET", "/s3cr3t/path"))
+		handler, err := NewHandlerFromRawConfig([]byte("url: ${PROXY_TEST_URL}/${file:" + secretFile + "}\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/path", nil))
+		Ω(recorder.Code).Should(Equal(http.StatusOK))
+		Ω(server.ReceivedRequests()).Should(HaveLen(1))
+	})
+
+	It("should keep escaped references", func() {
+		effective, err := ValidateRawConfig([]byte("url: http://localhost/$${PROXY_TEST_SECRET}\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(effective)).Should(ContainSubstring("url: http://localhost/$${PROXY_TEST_SECRET}\n"))
+	})
+
+	It("should report unset environment variables with their path", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: http://localhost\nmirror:\n  url: ${PROXY_TEST_UNSET}\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("mirror.url: environment variable PROXY_TEST_UNSET is not set"))
+	})
+
+	It("should report unreadable secret files", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: ${file:/nonexistent/secret}\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("url: cannot read secret file"))
+	})
+
+	It("should not reveal resolved values in errors", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: http://localhost\nflush_interval: ${PROXY_TEST_SECRET}\nproxy_path: ${file:" + secretFile + "}\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("<redacted>"))
+		Ω(err.Error()).ShouldNot(ContainSubstring("hunter2"))
+		Ω(err.Error()).ShouldNot(ContainSubstring("s3cr3t"))
+	})
+
+	It("should not reveal resolved values in validation errors", func() {
+		_, err := ValidateRawConfig([]byte("url: http://localhost\nflush_interval: ${PROXY_TEST_SECRET}\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).ShouldNot(ContainSubstring("hunter2"))
+	})
+
+	It("should not reveal the defaults of references in errors", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: http://localhost\nflush_interval: ${PROXY_TEST_UNSET:-hunter3}\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).ShouldNot(ContainSubstring("hunter3"))
+	})
+
+	It("should not reveal resolved values in validation output", func() {
+		effective, err := ValidateRawConfig([]byte("url: ${PROXY_TEST_URL}\ntracing:\n  endpoint: http://localhost:4318\n  headers:\n    Authorization: Bearer ${file:" + secretFile + "}\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(effective)).Should(ContainSubstring("url: ${PROXY_TEST_URL}\n"))
+		Ω(string(effective)).Should(ContainSubstring("Bearer ${file:" + secretFile + "}"))
+		Ω(string(effective)).ShouldNot(ContainSubstring("s3cr3t"))
+	})
+})
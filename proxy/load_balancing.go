@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Load balancing algorithms.
+const (
+	algorithmRoundRobin = "round_robin"
+	algorithmRingHash   = "ring_hash"
+	algorithmMaglev     = "maglev"
+)
+
+const (
+	defaultRingReplicas    = 160
+	defaultMaglevTableSize = 65537
+	minBoundedLoadFactor   = 1.0
+)
+
+type loadBalancingConfig struct {
+	Algorithm       string        `yaml:"algorithm"`
+	HashKey         hashKeyConfig `yaml:"hash_key"`
+	BoundedLoad     float64       `yaml:"bounded_load"`
+	RingReplicas    int           `yaml:"ring_replicas"`
+	MaglevTableSize int           `yaml:"maglev_table_size"`
+}
+
+type hashKeyConfig struct {
+	Path   bool   `yaml:"path"`
+	Header string `yaml:"header"`
+	Query  string `yaml:"query"`
+}
+
+// hashTable maps hashes of request keys to targets. lookup returns the
+// targets in the order they are to be tried for a hash, so that targets
+// at their load bound can be skipped.
+type hashTable interface {
+	lookup(hash uint64, try func(*poolTarget) bool) *poolTarget
+}
+
+// hashBalancer assigns requests to targets by the hash of a request key.
+// Lookup tables are built by the target pool whenever its targets change,
+// and unavailable targets are skipped on lookup, so that health changes do
+// not move keys between the other targets. With bounded loads, a target
+// receives at most boundedLoad times the average number of in-flight
+// requests, so that a single hot key can not overload a target.
+type hashBalancer struct {
+	key         hashKeyConfig
+	boundedLoad float64
+	build       func([]*poolTarget) hashTable
+}
+
+func (cfg loadBalancingConfig) validate(p *configProblems, path string) {
+	switch cfg.Algorithm {
+	case "", algorithmRoundRobin:
+		if cfg.HashKey != (hashKeyConfig{}) {
+			p.add(path+".hash_key", "requires a hash algorithm")
+		}
+		if cfg.BoundedLoad != 0 {
+			p.add(path+".bounded_load", "requires a hash algorithm")
+		}
+		return
+	case algorithmRingHash:
+		if cfg.RingReplicas < 0 {
+			p.add(path+".ring_replicas", "must not be negative")
+		}
+	case algorithmMaglev:
+		if cfg.MaglevTableSize != 0 && (cfg.MaglevTableSize < 0 || !isPrime(cfg.MaglevTableSize)) {
+			p.add(path+".maglev_table_size", "must be a prime number")
+		}
+	default:
+		p.add(path+".algorithm", "unknown load balancing algorithm %q", cfg.Algorithm)
+	}
+	if countSet(cfg.HashKey.Path, cfg.HashKey.Header != "", cfg.HashKey.Query != "") != 1 {
+		p.add(path+".hash_key", "must set exactly one of path, header or query")
+	}
+	if cfg.BoundedLoad != 0 && cfg.BoundedLoad < minBoundedLoadFactor {
+		p.add(path+".bounded_load", "must be at least %v", minBoundedLoadFactor)
+	}
+}
+
+func newHashBalancer(cfg *loadBalancingConfig) (*hashBalancer, error) {
+	if cfg == nil || cfg.Algorithm == algorithmRoundRobin {
+		return nil, nil
+	}
+	b := &hashBalancer{key: cfg.HashKey, boundedLoad: cfg.BoundedLoad}
+
+	switch cfg.Algorithm {
+	case algorithmRingHash:
+		replicas := cfg.RingReplicas
+		b.build = func(targets []*poolTarget) hashTable { return newHashRing(targets, replicas) }
+	case algorithmMaglev:
+		size := cfg.MaglevTableSize
+		b.build = func(targets []*poolTarget) hashTable { return newMaglevTable(targets, size) }
+	default:
+		return nil, fmt.Errorf("unknown load balancing algorithm: %q", cfg.Algorithm)
+	}
+	return b, nil
+}
+
+// pick returns the target for req from table or nil if req has no hash
+// key. Only targets for which available returns true are chosen, of which
+// there are len(targets).
+func (b *hashBalancer) pick(req *http.Request, table hashTable, targets []*poolTarget, available func(*poolTarget) bool) *poolTarget {
+	key, ok := b.hashKey(req)
+	if !ok {
+		return nil
+	}
+	hash := hashString(key)
+	if b.boundedLoad == 0 {
+		return table.lookup(hash, available)
+	}
+	var total int64
+	for _, target := range targets {
+		total += atomic.LoadInt64(&target.inFlight)
+	}
+	bound := int64(math.Ceil(b.boundedLoad * float64(total+1) / float64(len(targets))))
+	target := table.lookup(hash, func(target *poolTarget) bool {
+		return available(target) && atomic.LoadInt64(&target.inFlight) < bound
+	})
+	if target == nil || !available(target) {
+		target = table.lookup(hash, available)
+	}
+	return target
+}
+
+func (b *hashBalancer) hashKey(req *http.Request) (string, bool) {
+	var key string
+	switch {
+	case b.key.Path:
+		key = req.URL.Path
+	case b.key.Header != "":
+		key = req.Header.Get(b.key.Header)
+	case b.key.Query != "":
+		key = req.URL.Query().Get(b.key.Query)
+	}
+	return key, key != ""
+}
+
+type ringEntry struct {
+	hash   uint64
+	target *poolTarget
+}
+
+// hashRing places each target at a number of points on a ring. Keys are
+// assigned to the next point clockwise, so adding or removing a target
+// only moves the keys of its own points.
+type hashRing struct {
+	entries []ringEntry
+	targets int
+}
+
+func newHashRing(targets []*poolTarget, replicas int) *hashRing {
+	ring := &hashRing{targets: len(targets)}
+	for _, target := range targets {
+		for i := 0; i < replicas; i++ {
+			ring.entries = append(ring.entries, ringEntry{hash: hashString(target.id + "-" + strconv.Itoa(i)), target: target})
+		}
+	}
+	sort.Slice(ring.entries, func(i, j int) bool { return ring.entries[i].hash < ring.entries[j].hash })
+	return ring
+}
+
+func (r *hashRing) lookup(hash uint64, try func(*poolTarget) bool) *poolTarget {
+	if len(r.entries) == 0 {
+		return nil
+	}
+	start := sort.Search(len(r.entries), func(i int) bool { return r.entries[i].hash >= hash })
+	tried := make(map[*poolTarget]bool, r.targets)
+	for i := 0; i < len(r.entries) && len(tried) < r.targets; i++ {
+		target := r.entries[(start+i)%len(r.entries)].target
+		if tried[target] {
+			continue
+		}
+		if try(target) {
+			return target
+		}
+		tried[target] = true
+	}
+	return r.entries[start%len(r.entries)].target
+}
+
+// maglevTable is a lookup table as described in "Maglev: A Fast and
+// Reliable Software Network Load Balancer". Each target fills the table
+// following its own permutation of the slots, which spreads keys evenly
+// and moves few keys when targets change.
+type maglevTable struct {
+	slots   []*poolTarget
+	targets int
+}
+
+func newMaglevTable(targets []*poolTarget, size int) *maglevTable {
+	table := &maglevTable{slots: make([]*poolTarget, size), targets: len(targets)}
+	if len(targets) == 0 {
+		return table
+	}
+	offsets := make([]uint64, len(targets))
+	skips := make([]uint64, len(targets))
+	next := make([]uint64, len(targets))
+	for i, target := range targets {
+		offsets[i] = hashString(target.id) % uint64(size)
+		skips[i] = hashString("skip-"+target.id)%uint64(size-1) + 1
+	}
+	for filled := 0; ; {
+		for i, target := range targets {
+			slot := (offsets[i] + next[i]*skips[i]) % uint64(size)
+			for table.slots[slot] != nil {
+				next[i]++
+				slot = (offsets[i] + next[i]*skips[i]) % uint64(size)
+			}
+			table.slots[slot] = target
+			next[i]++
+			filled++
+			if filled == size {
+				return table
+			}
+		}
+	}
+}
+
+func (t *maglevTable) lookup(hash uint64, try func(*poolTarget) bool) *poolTarget {
+	if t.targets == 0 {
+		return nil
+	}
+	start := hash % uint64(len(t.slots))
+	tried := make(map[*poolTarget]bool, t.targets)
+	for i := uint64(0); i < uint64(len(t.slots)) && len(tried) < t.targets; i++ {
+		target := t.slots[(start+i)%uint64(len(t.slots))]
+		if tried[target] {
+			continue
+		}
+		if try(target) {
+			return target
+		}
+		tried[target] = true
+	}
+	return t.slots[start]
+}
+
+// hashString returns the FNV-1a hash of s with the finalizer of MurmurHash3
+// applied, as FNV alone spreads similar short keys poorly across the ring.
+func hashString(s string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(s))
+	h := hash.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for i := 2; i*i <= n; i++ {
+		if n%i == 0 {
+			return false
+		}
+	}
+	return true
+}
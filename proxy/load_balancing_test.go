@@ -0,0 +1,176 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Load balancing", func() {
+	var servers []*ghttp.Server
+	var release chan struct{}
+	var received chan int
+
+	newHandler := func(count int, balancingConfig string) http.Handler {
+		config := "targets:\n"
+		for _, server := range servers[:count] {
+			config += "- " + server.URL() + "\n"
+		}
+		handler, err := NewHandlerFromRawConfig([]byte(config + "load_balancing:\n" + balancingConfig))
+		Ω(err).ShouldNot(HaveOccurred())
+		return handler
+	}
+
+	serve := func(handler http.Handler, path string) int {
+		request, err := http.NewRequest("GET", "http://example.com"+path, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		var index int
+		fmt.Sscanf(response.Body.String(), "server-%d", &index)
+		return index
+	}
+
+	BeforeEach(func() {
+		release = nil
+		received = make(chan int, 100)
+		servers = nil
+		for i := 0; i < 4; i++ {
+			index := i
+			server := ghttp.NewServer()
+			server.AllowUnhandledRequests = true
+			server.RouteToHandler("GET", regexp.MustCompile("^/"), func(w http.ResponseWriter, req *http.Request) {
+				if release != nil {
+					received <- index
+					<-release
+				}
+				fmt.Fprintf(w, "server-%d", index)
+			})
+			servers = append(servers, server)
+		}
+	})
+
+	AfterEach(func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	})
+
+	for _, algorithm := range []string{"ring_hash", "maglev"} {
+		algorithm := algorithm
+
+		Context("when using "+algorithm, func() {
+			It("should send requests with the same key to the same target", func() {
+				handler := newHandler(3, "  algorithm: "+algorithm+"\n  hash_key:\n    path: true\n")
+				used := map[int]bool{}
+				for i := 0; i < 30; i++ {
+					path := fmt.Sprintf("/item/%d", i)
+					target := serve(handler, path)
+					used[target] = true
+					Ω(serve(handler, path)).Should(Equal(target))
+				}
+				Ω(used).Should(HaveLen(3))
+			})
+
+			It("should move few keys when a target is added", func() {
+				before := newHandler(3, "  algorithm: "+algorithm+"\n  hash_key:\n    query: key\n")
+				after := newHandler(4, "  algorithm: "+algorithm+"\n  hash_key:\n    query: key\n")
+				moved := 0
+				for i := 0; i < 200; i++ {
+					path := fmt.Sprintf("/?key=%d", i)
+					if serve(before, path) != serve(after, path) {
+						moved++
+					}
+				}
+				Ω(moved).Should(BeNumerically("<", 90))
+			})
+
+			It("should keep the keys of the other targets when a target fails", func() {
+				handler := newHandler(3, "  algorithm: "+algorithm+"\n  hash_key:\n    path: true\n")
+				targets := map[string]int{}
+				failing := ""
+				for i := 0; i < 30; i++ {
+					path := fmt.Sprintf("/item/%d", i)
+					targets[path] = serve(handler, path)
+					if targets[path] == 2 {
+						failing = path
+					}
+				}
+				Ω(failing).ShouldNot(BeEmpty())
+
+				servers[2].HTTPTestServer.Listener.Close()
+				servers[2].HTTPTestServer.CloseClientConnections()
+				serve(handler, failing)
+				for path, target := range targets {
+					if target == 2 {
+						Ω(serve(handler, path)).ShouldNot(Equal(2))
+					} else {
+						Ω(serve(handler, path)).Should(Equal(target))
+					}
+				}
+			})
+		})
+	}
+
+	Context("when using bounded loads", func() {
+		It("should spread a hot key across targets", func() {
+			release = make(chan struct{})
+			handler := newHandler(3, "  algorithm: ring_hash\n  hash_key:\n    header: X-Key\n  bounded_load: 1.25\n")
+			done := make(chan struct{}, 6)
+			for i := 0; i < 6; i++ {
+				go func() {
+					defer GinkgoRecover()
+					request, _ := http.NewRequest("GET", "http://example.com/", nil)
+					request.Header.Set("X-Key", "hot")
+					handler.ServeHTTP(httptest.NewRecorder(), request)
+					done <- struct{}{}
+				}()
+				Eventually(received).Should(HaveLen(i + 1))
+			}
+
+			counts := map[int]int{}
+			for i := 0; i < 6; i++ {
+				counts[<-received]++
+			}
+			close(release)
+			for i := 0; i < 6; i++ {
+				Eventually(done).Should(Receive())
+			}
+			Ω(len(counts)).Should(BeNumerically(">", 1))
+			for _, count := range counts {
+				Ω(count).Should(BeNumerically("<=", 3))
+			}
+		})
+	})
+})
+
+var _ = Describe("Load balancing configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte("targets: [http://localhost]\nload_balancing:\n" + config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail on unknown algorithm", func() {
+		itShouldFail("  algorithm: random\n  hash_key:\n    path: true\n")
+	})
+
+	It("should fail without hash key", func() {
+		itShouldFail("  algorithm: maglev\n")
+	})
+
+	It("should fail on bounded load below one", func() {
+		itShouldFail("  algorithm: ring_hash\n  hash_key:\n    path: true\n  bounded_load: 0.5\n")
+	})
+
+	It("should fail on table size that is no prime", func() {
+		itShouldFail("  algorithm: maglev\n  hash_key:\n    path: true\n  maglev_table_size: 1000\n")
+	})
+})
@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SAP/gologger"
+)
+
+const defaultMetricsPath = "/metrics"
+
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricsConfig struct {
+	Listen string `yaml:"listen"`
+	Path   string `yaml:"path"`
+}
+
+// proxyMetrics holds the metrics of proxied traffic.
+type proxyMetrics struct {
+	requests      *counterVec
+	duration      *histogramVec
+	upstreamTTFB  *histogramVec
+	requestBytes  *counterVec
+	responseBytes *counterVec
+	inFlight      *gauge
+	errors        *counterVec
+
+	mirrorComparisons *counterVec
+
+	openConnections         *gaugeVec
+	connectionUses          *counterVec
+	connectionWait          *histogramVec
+	connectionQueueTimeouts *counterVec
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		requests: newCounterVec("aker_proxy_requests_total",
+			"Number of proxied requests.", "upstream", "method", "status_class"),
+		duration: newHistogramVec("aker_proxy_request_duration_seconds",
+			"Total duration of proxied requests.", defaultLatencyBuckets, "upstream", "method", "status_class"),
+		upstreamTTFB: newHistogramVec("aker_proxy_upstream_first_byte_seconds",
+			"Time until the response headers are received from the upstream.", defaultLatencyBuckets, "upstream", "method"),
+		requestBytes: newCounterVec("aker_proxy_request_bytes_total",
+			"Number of request body bytes received from clients.", "upstream", "method"),
+		responseBytes: newCounterVec("aker_proxy_response_bytes_total",
+			"Number of response body bytes sent to clients.", "upstream", "method", "status_class"),
+		inFlight: newGauge("aker_proxy_requests_in_flight",
+			"Number of requests currently being proxied."),
+		errors: newCounterVec("aker_proxy_upstream_errors_total",
+			"Number of failed upstream round trips.", "upstream", "method", "class"),
+		mirrorComparisons: newCounterVec("aker_proxy_mirror_comparisons_total",
+			"Number of mirrored responses compared to the primary response.", "result"),
+		openConnections: newGaugeVec("aker_proxy_upstream_connections_open",
+			"Number of open upstream connections.", "address"),
+		connectionUses: newCounterVec("aker_proxy_upstream_connection_uses_total",
+			"Number of upstream requests by whether they reused a connection.", "upstream", "reused"),
+		connectionWait: newHistogramVec("aker_proxy_upstream_connection_wait_seconds",
+			"Time until upstream requests obtain a connection.", defaultLatencyBuckets, "upstream"),
+		connectionQueueTimeouts: newCounterVec("aker_proxy_upstream_connection_queue_timeouts_total",
+			"Number of upstream requests that did not obtain a connection within the queue timeout.", "upstream"),
+	}
+}
+
+// Wrap returns a handler that records the metrics of the requests served by
+// next.
+func (m *proxyMetrics) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		m.inFlight.add(1)
+		defer m.inFlight.add(-1)
+
+		req, info := withRequestInfo(req)
+		tw := &trackingResponseWriter{ResponseWriter: w}
+		// Deferred, so that requests whose response is aborted with
+		// http.ErrAbortHandler are recorded as well.
+		defer func() {
+			statusClass := fmt.Sprintf("%dxx", tw.Status()/100)
+			m.requests.add(1, info.upstream, req.Method, statusClass)
+			m.duration.observe(time.Since(start).Seconds(), info.upstream, req.Method, statusClass)
+			m.requestBytes.add(float64(info.receivedBytes()), info.upstream, req.Method)
+			m.responseBytes.add(float64(tw.bytes), info.upstream, req.Method, statusClass)
+		}()
+		next.ServeHTTP(tw, req)
+	})
+}
+
+// WrapTransport returns a round tripper that records the upstream metrics of
+// the requests sent through next.
+func (m *proxyMetrics) WrapTransport(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		upstream := upstreamLabel(req.URL)
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			m.errors.add(1, upstream, req.Method, classifyError(err))
+			return nil, err
+		}
+		m.upstreamTTFB.observe(time.Since(start).Seconds(), upstream, req.Method)
+		return resp, nil
+	})
+}
+
+func (m *proxyMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buffer bytes.Buffer
+	m.requests.writeTo(&buffer)
+	m.duration.writeTo(&buffer)
+	m.upstreamTTFB.writeTo(&buffer)
+	m.requestBytes.writeTo(&buffer)
+	m.responseBytes.writeTo(&buffer)
+	m.inFlight.writeTo(&buffer)
+	m.errors.writeTo(&buffer)
+	m.mirrorComparisons.writeTo(&buffer)
+	m.openConnections.writeTo(&buffer)
+	m.connectionUses.writeTo(&buffer)
+	m.connectionWait.writeTo(&buffer)
+	m.connectionQueueTimeouts.writeTo(&buffer)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buffer.Bytes())
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func upstreamLabel(u *url.URL) string {
+	if socketPath, ok := unixSocketOf(u.Host); ok {
+		return unixSocketScheme + "://" + socketPath
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+var (
+	metricsListenersMutex sync.Mutex
+	metricsListeners      = map[string]*proxyMetrics{}
+)
+
+func (cfg metricsConfig) validate(p *configProblems, path string) {
+	switch {
+	case cfg.Listen == "":
+		p.add(path+".listen", "must not be empty")
+	case strings.HasPrefix(cfg.Listen, "unix:"):
+		if strings.TrimPrefix(cfg.Listen, "unix:") == "" {
+			p.add(path+".listen", "must name a socket path after unix:")
+		}
+	default:
+		if _, port, err := net.SplitHostPort(cfg.Listen); err != nil {
+			p.add(path+".listen", "%v", err)
+		} else if _, err := net.LookupPort("tcp", port); err != nil {
+			p.add(path+".listen", "%v", err)
+		}
+	}
+}
+
+// serveMetrics returns the metrics exposed on the configured listener,
+// starting the listener if necessary. Listeners are started once per
+// address and keep running for the lifetime of the process, so handlers
+// created later for the same address share the metrics.
+func serveMetrics(cfg metricsConfig) (*proxyMetrics, error) {
+	metricsListenersMutex.Lock()
+	defer metricsListenersMutex.Unlock()
+	if metrics, ok := metricsListeners[cfg.Listen]; ok {
+		return metrics, nil
+	}
+
+	listener, err := listenMetrics(cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	metrics := newProxyMetrics()
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, metrics)
+	go http.Serve(listener, mux)
+	gologger.Infof("Serving metrics on %s%s", cfg.Listen, cfg.Path)
+
+	metricsListeners[cfg.Listen] = metrics
+	return metrics, nil
+}
+
+func listenMetrics(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(address, "unix:")
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (c *counterVec) add(value float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mutex.Lock()
+	c.values[key] += value
+	c.mutex.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+type gauge struct {
+	name  string
+	help  string
+	mutex sync.Mutex
+	value float64
+}
+
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) add(value float64) {
+	g.mutex.Lock()
+	g.value += value
+	g.mutex.Unlock()
+}
+
+func (g *gauge) writeTo(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value))
+}
+
+type gaugeVec struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (g *gaugeVec) add(value float64, labelValues ...string) {
+	key := formatLabels(g.labels, labelValues)
+	g.mutex.Lock()
+	g.values[key] += value
+	g.mutex.Unlock()
+}
+
+func (g *gaugeVec) writeTo(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, key, formatFloat(g.values[key]))
+	}
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+type histogramVec struct {
+	name       string
+	help       string
+	labels     []string
+	buckets    []float64
+	mutex      sync.Mutex
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		labels:     labels,
+		buckets:    buckets,
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hist, ok := h.histograms[key]
+	if !ok {
+		hist = &histogram{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.histograms[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		hist := h.histograms[key]
+		for i, bound := range h.buckets {
+			labels := formatLabels(bucketLabels, append(append([]string{}, hist.labelValues...), formatFloat(bound)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, hist.counts[i])
+		}
+		labels := formatLabels(bucketLabels, append(append([]string{}, hist.labelValues...), "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueReplacer.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
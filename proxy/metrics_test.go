@@ -0,0 +1,119 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Metrics", func() {
+	var fakeServer *ghttp.Server
+	var socketDir string
+	var socketPath string
+	var handler http.Handler
+
+	scrape := func() string {
+		client := &http.Client{
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.Dial("unix", socketPath)
+				},
+			},
+		}
+		resp, err := client.Get("http://localhost/metrics")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer resp.Body.Close()
+		Ω(resp.StatusCode).Should(Equal(http.StatusOK))
+		content, err := ioutil.ReadAll(resp.Body)
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(content)
+	}
+
+	BeforeEach(func() {
+		fakeServer = ghttp.NewServer()
+		var err error
+		socketDir, err = ioutil.TempDir("", "metrics")
+		Ω(err).ShouldNot(HaveOccurred())
+		socketPath = filepath.Join(socketDir, "metrics.sock")
+
+		handler, err = NewHandlerFromRawConfig([]byte("url: " + fakeServer.URL() + "\nmetrics:\n  listen: unix:" + socketPath + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		fakeServer.Close()
+		os.RemoveAll(socketDir)
+	})
+
+	Context("when requests are proxied", func() {
+		BeforeEach(func() {
+			fakeServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, "content"))
+			request, err := http.NewRequest("GET", "http://example.com/", nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+		})
+
+		It("should expose request metrics", func() {
+			labels := `{upstream="` + fakeServer.URL() + `",method="GET",status_class="2xx"}`
+			metrics := scrape()
+			Ω(metrics).Should(ContainSubstring("aker_proxy_requests_total" + labels + " 1\n"))
+			Ω(metrics).Should(ContainSubstring("aker_proxy_response_bytes_total" + labels + " 7\n"))
+			Ω(metrics).Should(ContainSubstring("aker_proxy_request_duration_seconds_count" + labels + " 1\n"))
+			Ω(metrics).Should(ContainSubstring("aker_proxy_requests_in_flight 0\n"))
+			Ω(metrics).Should(ContainSubstring(`aker_proxy_upstream_first_byte_seconds_count{upstream="` + fakeServer.URL() + `",method="GET"} 1`))
+		})
+	})
+
+	Context("when the response is aborted", func() {
+		BeforeEach(func() {
+			fakeServer.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("12345678"))
+				w.(http.Flusher).Flush()
+				w.Write([]byte("12345678"))
+			})
+			limited, err := NewHandlerFromRawConfig([]byte("url: " + fakeServer.URL() + "\nmax_response_body_bytes: 10\nmetrics:\n  listen: unix:" + socketPath + "\n"))
+			Ω(err).ShouldNot(HaveOccurred())
+			server := httptest.NewServer(limited)
+			defer server.Close()
+			resp, err := http.Get(server.URL + "/aborted")
+			Ω(err).ShouldNot(HaveOccurred())
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		})
+
+		It("should still record the request", func() {
+			labels := `{upstream="` + fakeServer.URL() + `",method="GET",status_class="2xx"}`
+			Eventually(scrape).Should(ContainSubstring("aker_proxy_requests_total" + labels + " 1\n"))
+			GinkgoWriter.Write([]byte(scrape()))
+			Ω(scrape()).Should(ContainSubstring("aker_proxy_requests_in_flight 0\n"))
+		})
+	})
+
+	Context("when the upstream can not be reached", func() {
+		var upstream string
+
+		BeforeEach(func() {
+			upstream = fakeServer.URL()
+			fakeServer.Close()
+			fakeServer = ghttp.NewServer()
+			request, err := http.NewRequest("POST", "http://example.com/", nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+		})
+
+		It("should count the upstream error", func() {
+			metrics := scrape()
+			Ω(metrics).Should(ContainSubstring(`aker_proxy_upstream_errors_total{upstream="` + upstream + `",method="POST",class="connection_refused"} 1`))
+			Ω(metrics).Should(ContainSubstring(`aker_proxy_requests_total{upstream="` + upstream + `",method="POST",status_class="5xx"} 1`))
+		})
+	})
+})
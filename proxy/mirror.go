@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/SAP/gologger"
+)
+
+const (
+	defaultMirrorMaxConcurrency = 16
+	defaultMirrorMaxBodyBytes   = 1024 * 1024
+	defaultMirrorTimeout        = 10 * time.Second
+	defaultMirrorTagHeader      = "X-Aker-Mirror"
+)
+
+type mirrorConfig struct {
+	URL            string               `yaml:"url"`
+	SampleRatio    *float64             `yaml:"sample_ratio"`
+	MaxConcurrency int                  `yaml:"max_concurrency"`
+	MaxBodyBytes   int64                `yaml:"max_body_bytes"`
+	Timeout        time.Duration        `yaml:"timeout"`
+	TagHeader      string               `yaml:"tag_header"`
+	Compare        *mirrorCompareConfig `yaml:"compare"`
+}
+
+// mirror sends copies of a sample of the upstream requests to a shadow
+// target. Mirrored requests are sent in the background and their responses
+// are discarded. Requests are not mirrored when the maximum number of
+// mirrored requests is in flight, so that a slow shadow can not slow down
+// the primary target.
+type mirror struct {
+	target       *url.URL
+	sampleRatio  float64
+	slots        chan struct{}
+	maxBodyBytes int64
+	timeout      time.Duration
+	tagHeader    string
+	comparer     *responseComparer
+}
+
+func (cfg mirrorConfig) validate(p *configProblems, path string) {
+	if cfg.URL == "" {
+		p.add(path+".url", "must not be empty")
+	} else {
+		p.checkUpstreamURL(path+".url", cfg.URL)
+	}
+	p.checkRatio(path+".sample_ratio", cfg.SampleRatio)
+	if cfg.MaxConcurrency < 0 {
+		p.add(path+".max_concurrency", "must not be negative")
+	}
+	if cfg.MaxBodyBytes < 0 {
+		p.add(path+".max_body_bytes", "must not be negative")
+	}
+	if cfg.Compare != nil {
+		cfg.Compare.validate(p, path+".compare")
+	}
+}
+
+func newMirror(cfg mirrorConfig) (*mirror, error) {
+	target, err := parseTargetURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror: %v", err)
+	}
+	m := &mirror{
+		target:       target,
+		sampleRatio:  *cfg.SampleRatio,
+		slots:        make(chan struct{}, cfg.MaxConcurrency),
+		maxBodyBytes: cfg.MaxBodyBytes,
+		timeout:      cfg.Timeout,
+		tagHeader:    cfg.TagHeader,
+	}
+	if cfg.Compare != nil {
+		m.comparer, err = newResponseComparer(*cfg.Compare)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// WrapTransport returns a round tripper that mirrors a sample of the
+// requests sent through next. Mirrored requests are sent through next as
+// well.
+func (m *mirror) WrapTransport(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if m.sampleRatio < 1 && rand.Float64() >= m.sampleRatio {
+			return next.RoundTrip(req)
+		}
+		if req.ContentLength > m.maxBodyBytes {
+			return next.RoundTrip(req)
+		}
+		select {
+		case m.slots <- struct{}{}:
+		default:
+			gologger.Debugf("Not mirroring request %s as too many mirrored requests are in flight", requestID(req))
+			return next.RoundTrip(req)
+		}
+
+		req, body, ok := m.teeBody(req)
+		if !ok {
+			<-m.slots
+			return next.RoundTrip(req)
+		}
+		if m.comparer == nil {
+			go m.send(next, m.shadowRequest(req, body), nil)
+			return next.RoundTrip(req)
+		}
+
+		primary := newComparedResponse(m.comparer.maxBodyBytes)
+		go m.send(next, m.shadowRequest(req, body), primary)
+		resp, err := next.RoundTrip(req)
+		primary.track(resp, err)
+		return resp, err
+	})
+}
+
+// teeBody reads the body of req, so that it can be sent to both targets.
+// It reports false if the body exceeds the maximum size or can not be read,
+// in which case the returned request still carries the complete body.
+func (m *mirror) teeBody(req *http.Request) (*http.Request, []byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil, true
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, m.maxBodyBytes+1))
+	clone := new(http.Request)
+	*clone = *req
+	if err != nil || int64(len(body)) > m.maxBodyBytes {
+		var rest io.Reader = req.Body
+		if err != nil {
+			rest = errorReader{err}
+		}
+		clone.Body = &multiReadCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), rest),
+			Closer: req.Body,
+		}
+		return clone, nil, false
+	}
+	req.Body.Close()
+	clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+	clone.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return clone, body, true
+}
+
+func (m *mirror) shadowRequest(req *http.Request, body []byte) *http.Request {
+	shadow := new(http.Request)
+	*shadow = *req
+	shadow.URL = new(url.URL)
+	*shadow.URL = *req.URL
+	shadow.URL.Scheme = m.target.Scheme
+	shadow.URL.Host = m.target.Host
+	shadow.URL.Path = joinPaths(m.target.Path, req.URL.Path)
+	shadow.URL.RawPath = ""
+	shadow.Host = upstreamHost(m.target)
+	shadow.Header = make(http.Header, len(req.Header)+1)
+	for name, values := range req.Header {
+		shadow.Header[name] = append([]string(nil), values...)
+	}
+	shadow.Header.Set(m.tagHeader, "true")
+	shadow.Body = nil
+	shadow.GetBody = nil
+	if body != nil {
+		shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return shadow
+}
+
+// send sends the shadow request with its own timeout, as the context of the
+// primary request ends with the primary response. If primary is not nil,
+// the shadow response is compared to it once both are complete.
+func (m *mirror) send(transport http.RoundTripper, shadow *http.Request, primary *comparedResponse) {
+	defer func() { <-m.slots }()
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	resp, err := transport.RoundTrip(shadow.WithContext(ctx))
+	if err != nil {
+		gologger.Debugf("Error mirroring request to %s: %v", m.target.Host, err)
+		if primary != nil {
+			m.comparer.count("error")
+		}
+		return
+	}
+	defer resp.Body.Close()
+	if primary == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return
+	}
+
+	response := newComparedResponse(m.comparer.maxBodyBytes)
+	response.read(resp)
+	select {
+	case <-primary.done:
+		m.comparer.compare(shadow, primary, response)
+	case <-ctx.Done():
+		gologger.Debugf("Not comparing mirrored response of request %s as the primary response did not complete in time", requestID(shadow))
+	}
+}
+
+// errorReader fails all reads with err.
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/SAP/gologger"
+)
+
+const (
+	defaultCompareMaxBodyBytes = 1024 * 1024
+	maxReportedDifferences     = 10
+)
+
+type mirrorCompareConfig struct {
+	Headers         []string `yaml:"headers"`
+	IgnoreJSONPaths []string `yaml:"ignore_json_paths"`
+	MaxBodyBytes    int64    `yaml:"max_body_bytes"`
+}
+
+// responseComparer compares the responses of the primary and the shadow
+// target. Bodies are compared as JSON documents if both responses are JSON,
+// otherwise byte by byte. Bodies larger than maxBodyBytes and encoded
+// bodies are not compared, and primary responses whose body was not read
+// completely, such as intercepted ones, are skipped.
+type responseComparer struct {
+	headers      []string
+	ignorePaths  [][]string
+	maxBodyBytes int64
+	metrics      *proxyMetrics
+}
+
+func (cfg mirrorCompareConfig) validate(p *configProblems, path string) {
+	if cfg.MaxBodyBytes < 0 {
+		p.add(path+".max_body_bytes", "must not be negative")
+	}
+	for i, jsonPath := range cfg.IgnoreJSONPaths {
+		if strings.TrimPrefix(strings.TrimPrefix(jsonPath, "$"), ".") == "" {
+			p.add(fmt.Sprintf("%s.ignore_json_paths[%d]", path, i), "must not be empty")
+		}
+	}
+}
+
+func newResponseComparer(cfg mirrorCompareConfig) (*responseComparer, error) {
+	c := &responseComparer{
+		maxBodyBytes: cfg.MaxBodyBytes,
+	}
+	for _, name := range cfg.Headers {
+		c.headers = append(c.headers, http.CanonicalHeaderKey(name))
+	}
+	for _, p := range cfg.IgnoreJSONPaths {
+		p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+		c.ignorePaths = append(c.ignorePaths, strings.Split(p, "."))
+	}
+	return c, nil
+}
+
+// comparedResponse is a response captured for comparison. done is closed
+// once the response is complete or its body is closed.
+type comparedResponse struct {
+	status     int
+	header     http.Header
+	body       *captureBuffer
+	incomplete bool
+	err        error
+	done       chan struct{}
+	once       sync.Once
+}
+
+func newComparedResponse(maxBodyBytes int64) *comparedResponse {
+	return &comparedResponse{
+		body: &captureBuffer{max: maxBodyBytes},
+		done: make(chan struct{}),
+	}
+}
+
+// track records resp, whose body is captured while it is read by the
+// proxy.
+func (r *comparedResponse) track(resp *http.Response, err error) {
+	if err != nil {
+		r.err = err
+		r.finish()
+		return
+	}
+	r.status = resp.StatusCode
+	r.header = resp.Header
+	body := &capturedBody{ReadCloser: resp.Body, buffer: r.body}
+	body.done = func() {
+		r.once.Do(func() {
+			r.incomplete = !body.complete
+			close(r.done)
+		})
+	}
+	resp.Body = body
+}
+
+// read records resp and reads its body.
+func (r *comparedResponse) read(resp *http.Response) {
+	r.status = resp.StatusCode
+	r.header = resp.Header
+	_, r.err = io.Copy(r.body, resp.Body)
+	r.finish()
+}
+
+func (r *comparedResponse) finish() {
+	r.once.Do(func() { close(r.done) })
+}
+
+// compare logs and counts the differences between the primary and the
+// shadow response of req.
+func (c *responseComparer) compare(req *http.Request, primary, shadow *comparedResponse) {
+	if primary.err != nil || shadow.err != nil {
+		c.count("error")
+		return
+	}
+	if primary.incomplete {
+		c.count("skipped")
+		gologger.Debugf("Not comparing mirrored response of request %s as the primary response was not read completely", requestID(req))
+		return
+	}
+	differences := c.differences(primary, shadow)
+	if len(differences) == 0 {
+		c.count("match")
+		gologger.Debugf("Mirrored response matches primary response of request %s", requestID(req))
+		return
+	}
+	c.count("mismatch")
+	if len(differences) > maxReportedDifferences {
+		differences = append(differences[:maxReportedDifferences], fmt.Sprintf("and %d more", len(differences)-maxReportedDifferences))
+	}
+	gologger.Warnf("Mirrored response differs from primary response of request %s %s %s: %s",
+		requestID(req), req.Method, req.URL.Path, strings.Join(differences, "; "))
+}
+
+func (c *responseComparer) count(result string) {
+	if c.metrics != nil {
+		c.metrics.mirrorComparisons.add(1, result)
+	}
+}
+
+func (c *responseComparer) differences(primary, shadow *comparedResponse) []string {
+	var differences []string
+	if primary.status != shadow.status {
+		differences = append(differences, fmt.Sprintf("status %d != %d", primary.status, shadow.status))
+	}
+	for _, name := range c.headers {
+		primaryValue := strings.Join(primary.header[name], ", ")
+		shadowValue := strings.Join(shadow.header[name], ", ")
+		if primaryValue != shadowValue {
+			differences = append(differences, fmt.Sprintf("header %s %q != %q", name, primaryValue, shadowValue))
+		}
+	}
+
+	primaryBody, primaryTruncated := primary.body.contents()
+	shadowBody, shadowTruncated := shadow.body.contents()
+	if primaryTruncated || shadowTruncated || isEncoded(primary.header) || isEncoded(shadow.header) {
+		return differences
+	}
+	if isJSONContent(primary.header.Get("Content-Type")) && isJSONContent(shadow.header.Get("Content-Type")) {
+		var primaryDocument, shadowDocument interface{}
+		if json.Unmarshal(primaryBody, &primaryDocument) == nil && json.Unmarshal(shadowBody, &shadowDocument) == nil {
+			for _, p := range c.ignorePaths {
+				primaryDocument = removeJSONPath(primaryDocument, p)
+				shadowDocument = removeJSONPath(shadowDocument, p)
+			}
+			return append(differences, jsonDifferences("$", primaryDocument, shadowDocument)...)
+		}
+	}
+	if !bytes.Equal(primaryBody, shadowBody) {
+		differences = append(differences, "body")
+	}
+	return differences
+}
+
+func isEncoded(header http.Header) bool {
+	encoding := header.Get("Content-Encoding")
+	return encoding != "" && !strings.EqualFold(encoding, "identity")
+}
+
+// removeJSONPath removes the value at path from document. The segment *
+// matches any key or index.
+func removeJSONPath(document interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return document
+	}
+	switch value := document.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				delete(value, key)
+			} else {
+				value[key] = removeJSONPath(child, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range value {
+			if path[0] != "*" && path[0] != strconv.Itoa(i) {
+				continue
+			}
+			if len(path) == 1 {
+				value[i] = nil
+			} else {
+				value[i] = removeJSONPath(child, path[1:])
+			}
+		}
+	}
+	return document
+}
+
+// jsonDifferences returns the paths at which the documents differ.
+func jsonDifferences(path string, primary, shadow interface{}) []string {
+	primaryObject, primaryIsObject := primary.(map[string]interface{})
+	shadowObject, shadowIsObject := shadow.(map[string]interface{})
+	if primaryIsObject && shadowIsObject {
+		keys := make(map[string]bool)
+		for key := range primaryObject {
+			keys[key] = true
+		}
+		for key := range shadowObject {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		var differences []string
+		for _, key := range sorted {
+			differences = append(differences, jsonDifferences(path+"."+key, primaryObject[key], shadowObject[key])...)
+		}
+		return differences
+	}
+
+	primaryArray, primaryIsArray := primary.([]interface{})
+	shadowArray, shadowIsArray := shadow.([]interface{})
+	if primaryIsArray && shadowIsArray && len(primaryArray) == len(shadowArray) {
+		var differences []string
+		for i := range primaryArray {
+			differences = append(differences, jsonDifferences(path+"."+strconv.Itoa(i), primaryArray[i], shadowArray[i])...)
+		}
+		return differences
+	}
+
+	if !reflect.DeepEqual(primary, shadow) {
+		return []string{"body " + path}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Mirror comparison", func() {
+	var primaryServer *ghttp.Server
+	var shadowServer *ghttp.Server
+	var shadowStatus int
+	var shadowHeader http.Header
+	var shadowBody string
+	var config string
+	var socketDir string
+	var socketPath string
+
+	scrape := func() string {
+		client := &http.Client{
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.Dial("unix", socketPath)
+				},
+			},
+		}
+		resp, err := client.Get("http://localhost/metrics")
+		if err != nil {
+			return ""
+		}
+		defer resp.Body.Close()
+		content, _ := ioutil.ReadAll(resp.Body)
+		return string(content)
+	}
+
+	BeforeEach(func() {
+		primaryServer = ghttp.NewServer()
+		primaryServer.AppendHandlers(ghttp.RespondWith(http.StatusOK,
+			`{"id":1,"name":"a","generated_at":"2016-01-01","items":[{"id":1,"etag":"x"}]}`,
+			http.Header{"Content-Type": {"application/json"}, "Cache-Control": {"no-cache"}}))
+		shadowStatus = http.StatusOK
+		shadowHeader = http.Header{"Content-Type": {"application/json"}, "Cache-Control": {"no-cache"}}
+		shadowBody = `{"name":"a","id":1,"generated_at":"2016-02-02","items":[{"id":1,"etag":"y"}]}`
+
+		config = ""
+		var err error
+		socketDir, err = ioutil.TempDir("", "mirror-compare")
+		Ω(err).ShouldNot(HaveOccurred())
+		socketPath = filepath.Join(socketDir, "metrics.sock")
+	})
+
+	AfterEach(func() {
+		primaryServer.Close()
+		shadowServer.Close()
+		os.RemoveAll(socketDir)
+	})
+
+	JustBeforeEach(func() {
+		shadowServer = ghttp.NewServer()
+		shadowServer.AppendHandlers(ghttp.RespondWith(shadowStatus, shadowBody, shadowHeader))
+
+		config = "url: " + primaryServer.URL() + "\nmirror:\n  url: " + shadowServer.URL() +
+			"\n  compare:\n    headers: [Cache-Control]\n    ignore_json_paths: [generated_at, items.*.etag]\n" +
+			"metrics:\n  listen: unix:" + socketPath + "\n" + config
+		handler, err := NewHandlerFromRawConfig([]byte(config))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		request, err := http.NewRequest("GET", "http://example.com/path", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		request.Header.Set("X-Aker-Request-Id", "some-request-id")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		Ω(response.Code).Should(Equal(http.StatusOK))
+	})
+
+	Context("when the responses only differ in ignored paths", func() {
+		It("should count a match", func() {
+			Eventually(scrape).Should(ContainSubstring(`aker_proxy_mirror_comparisons_total{result="match"} 1` + "\n"))
+		})
+	})
+
+	Context("when the responses differ", func() {
+		BeforeEach(func() {
+			shadowStatus = http.StatusCreated
+			shadowHeader.Set("Cache-Control", "max-age=60")
+			shadowBody = `{"id":2,"name":"a","items":[{"id":3}]}`
+		})
+
+		It("should count a mismatch", func() {
+			Eventually(scrape).Should(ContainSubstring(`aker_proxy_mirror_comparisons_total{result="mismatch"} 1` + "\n"))
+		})
+	})
+
+	Context("when only an ignored header differs", func() {
+		BeforeEach(func() {
+			shadowHeader.Set("Etag", "other")
+		})
+
+		It("should count a match", func() {
+			Eventually(scrape).Should(ContainSubstring(`aker_proxy_mirror_comparisons_total{result="match"} 1` + "\n"))
+		})
+	})
+
+	Context("when the shadow response is no JSON", func() {
+		BeforeEach(func() {
+			shadowHeader.Set("Content-Type", "text/plain")
+		})
+
+		It("should compare the bodies byte by byte", func() {
+			Eventually(scrape).Should(ContainSubstring(`aker_proxy_mirror_comparisons_total{result="mismatch"} 1` + "\n"))
+		})
+	})
+
+	Context("when the primary response is intercepted", func() {
+		BeforeEach(func() {
+			config = "intercept_errors:\n  - statuses: [200]\n    template: replaced\n"
+		})
+
+		It("should not compare the responses", func() {
+			Eventually(scrape).Should(ContainSubstring(`aker_proxy_mirror_comparisons_total{result="skipped"} 1` + "\n"))
+			Ω(scrape()).ShouldNot(ContainSubstring(`result="mismatch"`))
+		})
+	})
+})
@@ -0,0 +1,152 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Mirror", func() {
+	var primaryServer *ghttp.Server
+	var shadowServer *ghttp.Server
+	var mirrorConfig string
+	var primaryBody string
+	var shadowRequests chan *http.Request
+	var shadowBodies chan string
+	var handler http.Handler
+	var request *http.Request
+	var response *httptest.ResponseRecorder
+
+	BeforeEach(func() {
+		primaryServer = ghttp.NewServer()
+		primaryServer.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			primaryBody = string(body)
+			w.Write([]byte("primary"))
+		})
+		shadowRequests = make(chan *http.Request, 10)
+		shadowBodies = make(chan string, 10)
+		shadowServer = ghttp.NewServer()
+		shadowServer.AllowUnhandledRequests = true
+		shadowServer.RouteToHandler("POST", "/shadow/base/path", func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			shadowRequests <- req
+			shadowBodies <- string(body)
+			w.Write([]byte("shadow"))
+		})
+		mirrorConfig = ""
+
+		var err error
+		request, err = http.NewRequest("POST", "http://example.com/path", strings.NewReader("content"))
+		Ω(err).ShouldNot(HaveOccurred())
+		response = httptest.NewRecorder()
+	})
+
+	AfterEach(func() {
+		primaryServer.Close()
+		// Mirrored requests may still arrive, which would deadlock with
+		// ghttp closing the server while holding its lock.
+		shadowServer.HTTPTestServer.Close()
+	})
+
+	JustBeforeEach(func() {
+		config := "url: " + primaryServer.URL() + "/base\nmirror:\n  url: " + shadowServer.URL() + "/shadow\n" + mirrorConfig
+		var err error
+		handler, err = NewHandlerFromRawConfig([]byte(config))
+		Ω(err).ShouldNot(HaveOccurred())
+		handler.ServeHTTP(response, request)
+	})
+
+	It("should return the primary response", func() {
+		Ω(response.Code).Should(Equal(http.StatusOK))
+		Ω(response.Body.String()).Should(Equal("primary"))
+		Ω(primaryBody).Should(Equal("content"))
+	})
+
+	It("should send a tagged copy of the request to the shadow", func() {
+		var shadowRequest *http.Request
+		Eventually(shadowRequests).Should(Receive(&shadowRequest))
+		Ω(shadowRequest.Header.Get("X-Aker-Mirror")).Should(Equal("true"))
+		Ω(<-shadowBodies).Should(Equal("content"))
+	})
+
+	Context("when the body exceeds the maximum size", func() {
+		BeforeEach(func() {
+			mirrorConfig = "  max_body_bytes: 3\n"
+			request.ContentLength = -1
+		})
+
+		It("should forward the complete body to the primary only", func() {
+			Ω(primaryBody).Should(Equal("content"))
+			Consistently(shadowRequests, 100*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the sample ratio is zero", func() {
+		BeforeEach(func() {
+			mirrorConfig = "  sample_ratio: 0\n"
+		})
+
+		It("should not mirror the request", func() {
+			Ω(response.Body.String()).Should(Equal("primary"))
+			Consistently(shadowRequests, 100*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the shadow is slow", func() {
+		var release chan struct{}
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			shadowServer.RouteToHandler("POST", "/shadow/base/path", func(w http.ResponseWriter, req *http.Request) {
+				shadowRequests <- req
+				<-release
+			})
+			mirrorConfig = "  max_concurrency: 1\n"
+		})
+
+		AfterEach(func() {
+			close(release)
+		})
+
+		It("should not delay the primary response", func() {
+			Ω(response.Body.String()).Should(Equal("primary"))
+		})
+
+		It("should not exceed the concurrency limit", func() {
+			Eventually(shadowRequests).Should(Receive())
+
+			primaryServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, "again"))
+			second, err := http.NewRequest("POST", "http://example.com/path", nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, second)
+			Ω(recorder.Body.String()).Should(Equal("again"))
+			Consistently(shadowRequests, 100*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+})
+
+var _ = Describe("Mirror configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost\nmirror:\n" + config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail without url", func() {
+		itShouldFail("  sample_ratio: 0.5\n")
+	})
+
+	It("should fail on invalid sample ratio", func() {
+		itShouldFail("  url: http://shadow\n  sample_ratio: 1.5\n")
+	})
+})
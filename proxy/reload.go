@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/SAP/gologger"
+)
+
+const defaultConfigFilePollInterval = 5 * time.Second
+
+type configFileConfig struct {
+	Path         string        `yaml:"path"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// handlerResources are the files and background tasks of a handler.
+// Background tasks stop when the channel returned by stopped is closed.
+type handlerResources struct {
+	stop  chan struct{}
+	tasks bool
+	files []io.Closer
+}
+
+func newHandlerResources() *handlerResources {
+	return &handlerResources{stop: make(chan struct{})}
+}
+
+// stopped returns the channel that is closed on release, which background
+// tasks are to stop on.
+func (r *handlerResources) stopped() <-chan struct{} {
+	r.tasks = true
+	return r.stop
+}
+
+// inUse reports whether there is anything to release.
+func (r *handlerResources) inUse() bool {
+	return r.tasks || len(r.files) > 0
+}
+
+// closeOnRelease closes output on release if it is a file.
+func (r *handlerResources) closeOnRelease(output io.Writer) {
+	if file, ok := output.(io.Closer); ok {
+		r.files = append(r.files, file)
+	}
+}
+
+func (r *handlerResources) release() {
+	close(r.stop)
+	for _, file := range r.files {
+		file.Close()
+	}
+}
+
+// releasingHandler is a handler whose resources are released when it is
+// closed.
+type releasingHandler struct {
+	http.Handler
+	resources *handlerResources
+	closeOnce sync.Once
+}
+
+func (h *releasingHandler) Close() error {
+	h.closeOnce.Do(h.resources.release)
+	return nil
+}
+
+// handlerGeneration is a handler built from one version of the
+// configuration file. Once retired, it serves no new requests, and its
+// resources are released when its requests in flight have completed.
+type handlerGeneration struct {
+	http.Handler
+	resources *handlerResources
+	inFlight  int64
+	retired   int32
+	drained   chan struct{}
+	drainOnce sync.Once
+}
+
+func newHandlerGeneration(handler http.Handler, resources *handlerResources) *handlerGeneration {
+	return &handlerGeneration{Handler: handler, resources: resources, drained: make(chan struct{})}
+}
+
+// enter registers a request and returns false if the generation is retired.
+func (g *handlerGeneration) enter() bool {
+	atomic.AddInt64(&g.inFlight, 1)
+	if atomic.LoadInt32(&g.retired) == 1 {
+		g.leave()
+		return false
+	}
+	return true
+}
+
+func (g *handlerGeneration) leave() {
+	if atomic.AddInt64(&g.inFlight, -1) == 0 && atomic.LoadInt32(&g.retired) == 1 {
+		g.drainOnce.Do(func() { close(g.drained) })
+	}
+}
+
+func (g *handlerGeneration) retire() {
+	atomic.StoreInt32(&g.retired, 1)
+	if atomic.LoadInt64(&g.inFlight) == 0 {
+		g.drainOnce.Do(func() { close(g.drained) })
+	}
+	go func() {
+		<-g.drained
+		g.resources.release()
+	}()
+}
+
+// reloadingHandler serves requests with the handler of a configuration
+// file and replaces the handler when the file changes or the process
+// receives SIGHUP. Invalid configurations are logged and ignored, so that
+// the current handler stays in use.
+type reloadingHandler struct {
+	path     string
+	mutex    sync.Mutex
+	contents []byte
+	readErr  string
+	current  atomic.Value
+	signals  chan os.Signal
+	stop     chan struct{}
+	closed   bool
+}
+
+func newReloadingHandler(cfg handlerConfig) (http.Handler, error) {
+	fileCfg, err := checkConfigFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	h := &reloadingHandler{path: fileCfg.Path, stop: make(chan struct{})}
+	contents, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		return nil, err
+	}
+	handler, resources, err := newHandlerFromFile(contents)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %v", h.path, err)
+	}
+	h.contents = contents
+	h.current.Store(newHandlerGeneration(handler, resources))
+
+	h.signals = make(chan os.Signal, 1)
+	signal.Notify(h.signals, syscall.SIGHUP)
+	go h.watch(fileCfg.PollInterval)
+	return h, nil
+}
+
+// checkConfigFile returns the config_file of cfg with defaults filled in.
+func checkConfigFile(cfg handlerConfig) (configFileConfig, error) {
+	fileCfg := *cfg.ConfigFile
+	if !reflect.DeepEqual(cfg, handlerConfig{ConfigFile: cfg.ConfigFile, secrets: cfg.secrets}) {
+		return fileCfg, fmt.Errorf("config_file must not be combined with other properties")
+	}
+	if fileCfg.Path == "" {
+		return fileCfg, fmt.Errorf("config_file requires a path")
+	}
+	if fileCfg.PollInterval < 0 {
+		return fileCfg, fmt.Errorf("config_file poll_interval must not be negative")
+	}
+	if fileCfg.PollInterval == 0 {
+		fileCfg.PollInterval = defaultConfigFilePollInterval
+	}
+	return fileCfg, nil
+}
+
+func unmarshalConfigFile(contents []byte) (handlerConfig, error) {
+	cfg, err := unmarshalHandlerConfig(contents)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.ConfigFile != nil {
+		return cfg, fmt.Errorf("config_file must not be set in the configuration file")
+	}
+	return cfg, nil
+}
+
+func newHandlerFromFile(contents []byte) (http.Handler, *handlerResources, error) {
+	cfg, err := unmarshalConfigFile(contents)
+	if err != nil {
+		return nil, nil, err
+	}
+	handler, resources, err := newHandler(cfg)
+	return handler, resources, cfg.secrets.redact(err)
+}
+
+func (h *reloadingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for {
+		generation := h.current.Load().(*handlerGeneration)
+		if generation.enter() {
+			defer generation.leave()
+			generation.ServeHTTP(w, req)
+			return
+		}
+	}
+}
+
+func (h *reloadingHandler) watch(pollInterval time.Duration) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.reload(false)
+		case <-h.signals:
+			gologger.Infof("Reloading configuration from %s on SIGHUP", h.path)
+			h.reload(true)
+		}
+	}
+}
+
+// reload replaces the handler if the configuration file changed or force
+// is set.
+func (h *reloadingHandler) reload(force bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return
+	}
+
+	contents, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		if force || err.Error() != h.readErr {
+			gologger.Errorf("Reading configuration file failed, keeping current configuration: %v", err)
+			h.readErr = err.Error()
+		}
+		return
+	}
+	h.readErr = ""
+	if !force && bytes.Equal(contents, h.contents) {
+		return
+	}
+	h.contents = contents
+
+	handler, resources, err := newHandlerFromFile(contents)
+	if err != nil {
+		gologger.Errorf("Ignoring invalid configuration file %s, keeping current configuration: %v", h.path, err)
+		return
+	}
+	previous := h.current.Load().(*handlerGeneration)
+	h.current.Store(newHandlerGeneration(handler, resources))
+	previous.retire()
+	gologger.Infof("Reloaded configuration from %s", h.path)
+}
+
+// Close stops watching the configuration file and SIGHUP and releases the
+// resources of the current handler.
+func (h *reloadingHandler) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	signal.Stop(h.signals)
+	close(h.stop)
+	h.current.Load().(*handlerGeneration).resources.release()
+	return nil
+}
@@ -0,0 +1,150 @@
+package proxy_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Configuration reload", func() {
+	var dir string
+	var path string
+	var pollInterval string
+	var firstServer *ghttp.Server
+	var secondServer *ghttp.Server
+	var handler http.Handler
+
+	serve := func() *httptest.ResponseRecorder {
+		request, err := http.NewRequest("GET", "http://example.com/path", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	writeConfig := func(contents string) {
+		Ω(ioutil.WriteFile(path, []byte(contents), 0644)).Should(Succeed())
+	}
+
+	received := func(server *ghttp.Server) func() int {
+		return func() int {
+			Ω(serve().Code).Should(Equal(http.StatusOK))
+			return len(server.ReceivedRequests())
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		Ω(err).ShouldNot(HaveOccurred())
+		path = filepath.Join(dir, "proxy.yml")
+		pollInterval = "10ms"
+
+		firstServer = ghttp.NewServer()
+		firstServer.AllowUnhandledRequests = true
+		firstServer.UnhandledRequestStatusCode = http.StatusOK
+		secondServer = ghttp.NewServer()
+		secondServer.AllowUnhandledRequests = true
+		secondServer.UnhandledRequestStatusCode = http.StatusOK
+		writeConfig("url: " + firstServer.URL() + "\n")
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		handler, err = NewHandlerFromRawConfig([]byte("config_file:\n  path: " + path + "\n  poll_interval: " + pollInterval + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Ω(handler.(io.Closer).Close()).Should(Succeed())
+		firstServer.Close()
+		secondServer.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should serve requests with the configuration of the file", func() {
+		Ω(serve().Code).Should(Equal(http.StatusOK))
+		Ω(firstServer.ReceivedRequests()).Should(HaveLen(1))
+	})
+
+	It("should reload the configuration when the file changes", func() {
+		writeConfig("url: " + secondServer.URL() + "\n")
+		Eventually(received(secondServer)).ShouldNot(BeZero())
+	})
+
+	It("should keep the configuration when the file is invalid", func() {
+		writeConfig("url: " + secondServer.URL() + "\nhealth:\n  max_failures: 3\n")
+		Consistently(received(secondServer), "100ms").Should(BeZero())
+	})
+
+	It("should complete requests in flight with the previous configuration", func() {
+		release := make(chan struct{})
+		firstServer.RouteToHandler("GET", "/slow", func(w http.ResponseWriter, req *http.Request) {
+			<-release
+		})
+		done := make(chan int)
+		go func() {
+			defer GinkgoRecover()
+			request, _ := http.NewRequest("GET", "http://example.com/slow", nil)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			done <- response.Code
+		}()
+		Eventually(firstServer.ReceivedRequests).Should(HaveLen(1))
+
+		writeConfig("url: " + secondServer.URL() + "\n")
+		Eventually(received(secondServer)).ShouldNot(BeZero())
+		close(release)
+		Eventually(done).Should(Receive(Equal(http.StatusOK)))
+	})
+
+	Context("when the file is not polled", func() {
+		BeforeEach(func() {
+			pollInterval = "1h"
+		})
+
+		It("should reload the configuration on SIGHUP", func() {
+			writeConfig("url: " + secondServer.URL() + "\n")
+			Ω(syscall.Kill(os.Getpid(), syscall.SIGHUP)).Should(Succeed())
+			Eventually(received(secondServer)).ShouldNot(BeZero())
+		})
+
+		It("should stop receiving SIGHUP when closed", func() {
+			hangups := make(chan os.Signal, 1)
+			signal.Notify(hangups, syscall.SIGHUP)
+			defer signal.Stop(hangups)
+
+			Ω(handler.(io.Closer).Close()).Should(Succeed())
+			Ω(syscall.Kill(os.Getpid(), syscall.SIGHUP)).Should(Succeed())
+			Eventually(hangups).Should(Receive())
+			Consistently(ReloadSignals(handler), "100ms").ShouldNot(Receive())
+		})
+	})
+})
+
+var _ = Describe("Configuration reload configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte(config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail on missing file", func() {
+		itShouldFail("config_file:\n  path: /does/not/exist.yml\n")
+	})
+
+	It("should fail on other properties", func() {
+		itShouldFail("url: http://localhost\nconfig_file:\n  path: /does/not/exist.yml\n")
+	})
+})
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+const requestIDHeader = "X-Aker-Request-Id"
+
+type requestIDKey struct{}
+
+// rememberRequestID stores the request id in the context of the upstream
+// request, so that it is still known after internal headers are removed.
+// It is meant to be called by the Director of the reverse proxy, which works
+// on a copy of the original request.
+func rememberRequestID(req *http.Request) {
+	ctx := context.WithValue(req.Context(), requestIDKey{}, req.Header.Get(requestIDHeader))
+	*req = *req.WithContext(ctx)
+}
+
+func requestID(req *http.Request) string {
+	if id, ok := req.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return req.Header.Get(requestIDHeader)
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo collects details about a proxied request that are only known
+// deep inside the reverse proxy, such as the chosen upstream, so that they
+// can be reported once the request is done.
+type requestInfo struct {
+	upstream         string
+	upstreamPath     string
+	upstreamDuration time.Duration
+	requestBytes     int64
+	attempts         int32
+}
+
+func (i *requestInfo) receivedBytes() int64 {
+	return atomic.LoadInt64(&i.requestBytes)
+}
+
+// retries returns the number of times the request was sent again to the
+// upstream, such as when the transport retried it after a reused
+// connection had been closed.
+func (i *requestInfo) retries() int {
+	if attempts := atomic.LoadInt32(&i.attempts); attempts > 1 {
+		return int(attempts - 1)
+	}
+	return 0
+}
+
+// withRequestInfo returns a shallow copy of req whose context carries a new
+// requestInfo. The request body is wrapped to count the bytes read. Requests
+// that already carry a requestInfo are returned unchanged.
+func withRequestInfo(req *http.Request) (*http.Request, *requestInfo) {
+	if info := requestInfoOf(req); info != nil {
+		return req, info
+	}
+	info := &requestInfo{}
+	req = req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &countingBody{ReadCloser: req.Body, count: &info.requestBytes}
+	}
+	return req, info
+}
+
+// requestInfoOf returns the requestInfo of req or nil if there is none.
+func requestInfoOf(req *http.Request) *requestInfo {
+	info, _ := req.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+type countingBody struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (b *countingBody) Read(data []byte) (int, error) {
+	n, err := b.ReadCloser.Read(data)
+	atomic.AddInt64(b.count, int64(n))
+	return n, err
+}
+
+// trackRequestInfo returns a round tripper that records the upstream details
+// of the requests sent through next in their requestInfo.
+func trackRequestInfo(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		info := requestInfoOf(req)
+		if info == nil {
+			return next.RoundTrip(req)
+		}
+		info.upstream = upstreamLabel(req.URL)
+		info.upstreamPath = req.URL.RequestURI()
+		trace := &httptrace.ClientTrace{
+			GotConn: func(httptrace.GotConnInfo) {
+				atomic.AddInt32(&info.attempts, 1)
+			},
+		}
+		start := time.Now()
+		resp, err := next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		info.upstreamDuration = time.Since(start)
+		return resp, err
+	})
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+const defaultUploadGracePeriod = 5 * time.Second
+
+var errUploadTooSlow = errors.New("request body upload rate is below the configured minimum")
+var errRequestBodyUnreadable = errors.New("request body could not be read")
+
+type requestLimiter struct {
+	maxBodyBytes  int64
+	minUploadRate int64
+	gracePeriod   time.Duration
+	buffer        bool
+	// handleError responds to requests that are rejected, like the
+	// ErrorHandler of the reverse proxy.
+	handleError func(http.ResponseWriter, *http.Request, error)
+}
+
+// checkRequestLimits adds the problems of the request limits of cfg.
+func (p *configProblems) checkRequestLimits(cfg handlerConfig) {
+	if cfg.MaxRequestBodyBytes < 0 {
+		p.add("max_request_body_bytes", "must not be negative")
+	}
+	if cfg.MinUploadRate < 0 {
+		p.add("min_upload_rate", "must not be negative")
+	}
+	if cfg.BufferRequests && cfg.MaxRequestBodyBytes == 0 {
+		p.add("buffer_requests", "requires max_request_body_bytes")
+	}
+}
+
+func newRequestLimiter(cfg handlerConfig) (*requestLimiter, error) {
+	limiter := &requestLimiter{
+		maxBodyBytes:  cfg.MaxRequestBodyBytes,
+		minUploadRate: cfg.MinUploadRate,
+		gracePeriod:   cfg.UploadGracePeriod,
+		buffer:        cfg.BufferRequests,
+		handleError:   defaultErrorResponder.HandleError,
+	}
+	return limiter, nil
+}
+
+func (l *requestLimiter) enabled() bool {
+	return l.maxBodyBytes > 0 || l.minUploadRate > 0 || l.buffer
+}
+
+// Wrap returns a handler that enforces the request body limits before the
+// request is passed to next.
+func (l *requestLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if l.maxBodyBytes > 0 && req.ContentLength > l.maxBodyBytes {
+			l.handleError(w, req, &http.MaxBytesError{Limit: l.maxBodyBytes})
+			return
+		}
+		if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if l.minUploadRate > 0 {
+			req.Body = &minRateBody{
+				ReadCloser: req.Body,
+				controller: http.NewResponseController(w),
+				minRate:    l.minUploadRate,
+				start:      time.Now().Add(l.gracePeriod),
+			}
+		}
+		if l.maxBodyBytes > 0 {
+			req.Body = http.MaxBytesReader(w, req.Body, l.maxBodyBytes)
+		}
+		if l.buffer {
+			data, err := ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				if requestBodyErrorStatus(err) == 0 {
+					err = fmt.Errorf("%w: %v", errRequestBodyUnreadable, err)
+				}
+				l.handleError(w, req, err)
+				return
+			}
+			req.ContentLength = int64(len(data))
+			req.TransferEncoding = nil
+			req.Body = ioutil.NopCloser(bytes.NewReader(data))
+			req.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(data)), nil
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// requestBodyErrorStatus returns the status code that describes err when it
+// is caused by the request body limits, or zero otherwise.
+func requestBodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errUploadTooSlow):
+		return http.StatusRequestTimeout
+	}
+	return 0
+}
+
+// minRateBody fails reading once fewer bytes than the minimum rate allows
+// have arrived since start. Where the connection supports it, the read
+// deadline is moved along so that a stalled client is detected without
+// waiting for its next write.
+type minRateBody struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	minRate    int64
+	start      time.Time
+	read       int64
+}
+
+func (b *minRateBody) Read(data []byte) (int, error) {
+	b.controller.SetReadDeadline(b.deadline(b.read + 1))
+	n, err := b.ReadCloser.Read(data)
+	b.read += int64(n)
+	if err == io.EOF {
+		b.controller.SetReadDeadline(time.Time{})
+		return n, err
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return n, errUploadTooSlow
+	}
+	if err == nil && time.Now().After(b.deadline(b.read)) {
+		return n, errUploadTooSlow
+	}
+	return n, err
+}
+
+func (b *minRateBody) Close() error {
+	b.controller.SetReadDeadline(time.Time{})
+	return b.ReadCloser.Close()
+}
+
+func (b *minRateBody) deadline(bytes int64) time.Time {
+	seconds := float64(bytes) / float64(b.minRate)
+	return b.start.Add(time.Duration(seconds * float64(time.Second)))
+}
@@ -0,0 +1,190 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+type slowReader struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+var _ = Describe("Request limits", func() {
+	var fakeServer *ghttp.Server
+	var config string
+	var request *http.Request
+	var response *httptest.ResponseRecorder
+
+	BeforeEach(func() {
+		fakeServer = ghttp.NewServer()
+		response = httptest.NewRecorder()
+		fakeServer.AllowUnhandledRequests = true
+		fakeServer.UnhandledRequestStatusCode = http.StatusOK
+	})
+
+	AfterEach(func() {
+		fakeServer.Close()
+	})
+
+	JustBeforeEach(func() {
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + fakeServer.URL() + "\n" + config))
+		Ω(err).ShouldNot(HaveOccurred())
+		handler.ServeHTTP(response, request)
+	})
+
+	Context("when max request body size is configured", func() {
+		BeforeEach(func() {
+			config = "max_request_body_bytes: 10"
+		})
+
+		Context("and the content length exceeds it", func() {
+			BeforeEach(func() {
+				var err error
+				request, err = http.NewRequest("POST", "http://example.com/", strings.NewReader("more than ten bytes"))
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("should respond with 413 without calling the server", func() {
+				Ω(response.Code).Should(Equal(http.StatusRequestEntityTooLarge))
+				Ω(fakeServer.ReceivedRequests()).Should(BeEmpty())
+			})
+		})
+
+		Context("and error responses are configured", func() {
+			BeforeEach(func() {
+				config += "\nerror_responses:\n  formats: [plain]\n  statuses:\n    request_body_too_large: 400"
+				var err error
+				request, err = http.NewRequest("POST", "http://example.com/", strings.NewReader("more than ten bytes"))
+				Ω(err).ShouldNot(HaveOccurred())
+				request.Header.Set("X-Aker-Request-Id", "some-request-id")
+			})
+
+			It("should respond through the error responder", func() {
+				Ω(response.Code).Should(Equal(http.StatusBadRequest))
+				Ω(response.Header().Get("Content-Type")).Should(HavePrefix("text/plain"))
+				Ω(response.Body.String()).Should(ContainSubstring("The request body is too large."))
+				Ω(response.Body.String()).Should(ContainSubstring("Request ID: some-request-id"))
+			})
+		})
+
+		Context("and a body of unknown length exceeds it", func() {
+			BeforeEach(func() {
+				var err error
+				request, err = http.NewRequest("POST", "http://example.com/", io.MultiReader(strings.NewReader("more than ten bytes")))
+				Ω(err).ShouldNot(HaveOccurred())
+				request.ContentLength = -1
+			})
+
+			It("should respond with 413", func() {
+				Ω(response.Code).Should(Equal(http.StatusRequestEntityTooLarge))
+			})
+		})
+
+		Context("and the body is within the limit", func() {
+			BeforeEach(func() {
+				var err error
+				request, err = http.NewRequest("POST", "http://example.com/", strings.NewReader("small"))
+				Ω(err).ShouldNot(HaveOccurred())
+				fakeServer.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyBody([]byte("small")),
+					ghttp.RespondWith(http.StatusOK, "ok"),
+				))
+			})
+
+			It("should forward the request", func() {
+				Ω(response.Code).Should(Equal(http.StatusOK))
+				Ω(fakeServer.ReceivedRequests()).Should(HaveLen(1))
+			})
+		})
+	})
+
+	Context("when requests are buffered", func() {
+		BeforeEach(func() {
+			config = "max_request_body_bytes: 100\nbuffer_requests: true"
+			var err error
+			request, err = http.NewRequest("POST", "http://example.com/", io.MultiReader(strings.NewReader("buffered")))
+			Ω(err).ShouldNot(HaveOccurred())
+			request.ContentLength = -1
+			fakeServer.AppendHandlers(ghttp.CombineHandlers(
+				func(w http.ResponseWriter, req *http.Request) {
+					Ω(req.ContentLength).Should(Equal(int64(len("buffered"))))
+				},
+				ghttp.VerifyBody([]byte("buffered")),
+				ghttp.RespondWith(http.StatusOK, "ok"),
+			))
+		})
+
+		It("should forward the request with known content length", func() {
+			Ω(response.Code).Should(Equal(http.StatusOK))
+			Ω(fakeServer.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Context("when a buffered body can not be read", func() {
+		BeforeEach(func() {
+			config = "max_request_body_bytes: 100\nbuffer_requests: true\nerror_responses:\n  formats: [plain]"
+			var err error
+			request, err = http.NewRequest("POST", "http://example.com/", io.MultiReader(strings.NewReader("trunc"), failingReader{}))
+			Ω(err).ShouldNot(HaveOccurred())
+			request.ContentLength = -1
+		})
+
+		It("should respond with 400 through the error responder", func() {
+			Ω(response.Code).Should(Equal(http.StatusBadRequest))
+			Ω(response.Body.String()).Should(ContainSubstring("The request body could not be read."))
+			Ω(fakeServer.ReceivedRequests()).Should(BeEmpty())
+		})
+	})
+
+	Context("when the client uploads too slowly", func() {
+		BeforeEach(func() {
+			config = "min_upload_rate: 1000\nupload_grace_period: 10ms\nmax_request_body_bytes: 100\nbuffer_requests: true"
+			var err error
+			request, err = http.NewRequest("POST", "http://example.com/", &slowReader{
+				data:  []byte("slow"),
+				delay: 20 * time.Millisecond,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			request.ContentLength = 4
+		})
+
+		It("should respond with 408 without calling the server", func() {
+			Ω(response.Code).Should(Equal(http.StatusRequestTimeout))
+			Ω(fakeServer.ReceivedRequests()).Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Request limits configuration", func() {
+	It("should fail when buffering is configured without a size limit", func() {
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost\nbuffer_requests: true"))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	})
+})
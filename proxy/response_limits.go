@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/SAP/gologger"
+)
+
+var errResponseBodyTooLarge = errors.New("upstream response body exceeds the configured maximum size")
+var errResponseReadTimeout = errors.New("upstream response body was not read within the configured timeout")
+
+type responseLimiter struct {
+	maxBodyBytes int64
+	readTimeout  time.Duration
+	bufferBytes  int64
+}
+
+// checkResponseLimits adds the problems of the response limits of cfg.
+func (p *configProblems) checkResponseLimits(cfg handlerConfig) {
+	if cfg.MaxResponseBodyBytes < 0 {
+		p.add("max_response_body_bytes", "must not be negative")
+	}
+	if cfg.ResponseBufferBytes < 0 {
+		p.add("response_buffer_bytes", "must not be negative")
+	}
+}
+
+func newResponseLimiter(cfg handlerConfig) (*responseLimiter, error) {
+	return &responseLimiter{
+		maxBodyBytes: cfg.MaxResponseBodyBytes,
+		readTimeout:  cfg.ResponseReadTimeout,
+		bufferBytes:  cfg.ResponseBufferBytes,
+	}, nil
+}
+
+func (l *responseLimiter) enabled() bool {
+	return l.maxBodyBytes > 0 || l.readTimeout > 0 || l.bufferBytes > 0
+}
+
+// LimitResponse enforces the response limits on the upstream response. It is
+// meant to be used as ModifyResponse of the reverse proxy. Errors returned
+// before the response is committed result in a 502 response, errors that
+// happen while the body is streamed to the client abort the response.
+func (l *responseLimiter) LimitResponse(resp *http.Response) error {
+	if l.maxBodyBytes > 0 && resp.ContentLength > l.maxBodyBytes {
+		return errResponseBodyTooLarge
+	}
+
+	body := &limitedResponseBody{
+		body:      resp.Body,
+		maxBytes:  l.maxBodyBytes,
+		requestID: requestID(resp.Request),
+	}
+	if l.readTimeout > 0 {
+		body.timer = time.AfterFunc(l.readTimeout, body.timeout)
+	}
+	resp.Body = body
+
+	if l.bufferBytes == 0 {
+		body.logAborts = true
+		return nil
+	}
+	buffered, err := ioutil.ReadAll(io.LimitReader(body, l.bufferBytes+1))
+	if err != nil {
+		body.Close()
+		return err
+	}
+	if int64(len(buffered)) <= l.bufferBytes {
+		body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(buffered))
+		resp.ContentLength = int64(len(buffered))
+		resp.Header.Set("Content-Length", fmt.Sprint(len(buffered)))
+		resp.TransferEncoding = nil
+		return nil
+	}
+	body.logAborts = true
+	resp.Body = &multiReadCloser{
+		Reader: io.MultiReader(bytes.NewReader(buffered), body),
+		Closer: body,
+	}
+	return nil
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type limitedResponseBody struct {
+	body      io.ReadCloser
+	maxBytes  int64
+	read      int64
+	requestID string
+	timer     *time.Timer
+	timedOut  int32
+	logAborts bool
+	err       error
+}
+
+func (b *limitedResponseBody) Read(data []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.maxBytes > 0 && int64(len(data)) > b.maxBytes-b.read+1 {
+		data = data[:b.maxBytes-b.read+1]
+	}
+	n, err := b.body.Read(data)
+	b.read += int64(n)
+	switch {
+	case atomic.LoadInt32(&b.timedOut) == 1:
+		b.abort(errResponseReadTimeout)
+		return n, b.err
+	case b.maxBytes > 0 && b.read > b.maxBytes:
+		b.abort(errResponseBodyTooLarge)
+		return n - int(b.read-b.maxBytes), b.err
+	case err == io.EOF && b.timer != nil:
+		b.timer.Stop()
+	}
+	return n, err
+}
+
+func (b *limitedResponseBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return b.body.Close()
+}
+
+func (b *limitedResponseBody) timeout() {
+	atomic.StoreInt32(&b.timedOut, 1)
+	b.body.Close()
+}
+
+func (b *limitedResponseBody) abort(err error) {
+	b.err = err
+	if b.logAborts {
+		gologger.Errorf("Aborting response to request %s: %v", b.requestID, err)
+	}
+}
@@ -0,0 +1,113 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Response limits", func() {
+	var fakeServer *ghttp.Server
+	var config string
+	var request *http.Request
+	var response *httptest.ResponseRecorder
+
+	respondInChunks := func(chunks []string, delay time.Duration) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			for _, chunk := range chunks {
+				w.Write([]byte(chunk))
+				w.(http.Flusher).Flush()
+				time.Sleep(delay)
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		fakeServer = ghttp.NewServer()
+		response = httptest.NewRecorder()
+		var err error
+		request, err = http.NewRequest("GET", "http://example.com/", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		fakeServer.Close()
+	})
+
+	JustBeforeEach(func() {
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + fakeServer.URL() + "\n" + config))
+		Ω(err).ShouldNot(HaveOccurred())
+		handler.ServeHTTP(response, request)
+	})
+
+	Context("when max response body size is configured", func() {
+		BeforeEach(func() {
+			config = "max_response_body_bytes: 10"
+		})
+
+		Context("and the content length exceeds it", func() {
+			BeforeEach(func() {
+				fakeServer.AppendHandlers(ghttp.RespondWith(http.StatusOK, "more than ten bytes"))
+			})
+
+			It("should respond with 502", func() {
+				Ω(response.Code).Should(Equal(http.StatusBadGateway))
+				Ω(response.Body.String()).Should(BeEmpty())
+			})
+		})
+
+		Context("and a streamed body exceeds it", func() {
+			BeforeEach(func() {
+				fakeServer.AppendHandlers(respondInChunks([]string{"12345678", "12345678"}, 0))
+			})
+
+			It("should truncate the response at the limit", func() {
+				Ω(response.Code).Should(Equal(http.StatusOK))
+				Ω(response.Body.String()).Should(Equal("1234567812"))
+			})
+		})
+
+		Context("and responses are buffered", func() {
+			BeforeEach(func() {
+				config += "\nresponse_buffer_bytes: 100"
+				fakeServer.AppendHandlers(respondInChunks([]string{"12345678", "12345678"}, 0))
+			})
+
+			It("should respond with 502 instead of a truncated body", func() {
+				Ω(response.Code).Should(Equal(http.StatusBadGateway))
+				Ω(response.Body.String()).Should(BeEmpty())
+			})
+		})
+
+		Context("and the body is within the limit", func() {
+			BeforeEach(func() {
+				config += "\nresponse_buffer_bytes: 100"
+				fakeServer.AppendHandlers(respondInChunks([]string{"1234", "5678"}, 0))
+			})
+
+			It("should return the whole body", func() {
+				Ω(response.Code).Should(Equal(http.StatusOK))
+				Ω(response.Header().Get("Content-Length")).Should(Equal("8"))
+				Ω(response.Body.String()).Should(Equal("12345678"))
+			})
+		})
+	})
+
+	Context("when the upstream response is too slow", func() {
+		BeforeEach(func() {
+			config = "response_read_timeout: 50ms\nresponse_buffer_bytes: 100"
+			fakeServer.AppendHandlers(respondInChunks(strings.Split("slow", ""), 30*time.Millisecond))
+		})
+
+		It("should respond with 502", func() {
+			Ω(response.Code).Should(Equal(http.StatusBadGateway))
+		})
+	})
+})
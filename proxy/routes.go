@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+type routeConfig struct {
+	Path      string            `yaml:"path"`
+	Methods   []string          `yaml:"methods"`
+	Host      string            `yaml:"host"`
+	Headers   map[string]string `yaml:"headers"`
+	Query     map[string]string `yaml:"query"`
+	Cookies   map[string]string `yaml:"cookies"`
+	URL       string            `yaml:"url"`
+	ProxyPath string            `yaml:"proxy_path"`
+	Canary    *canaryConfig     `yaml:"canary"`
+}
+
+// route forwards the requests it matches to its own target.
+type route struct {
+	routeConfig
+	target *url.URL
+	canary *canary
+}
+
+type routeKey struct{}
+
+var errNoRoute = errors.New("no route matches the request")
+
+// router selects the route of each request. The reverse proxy forwards
+// requests without a route to the default target.
+type router struct {
+	routes     []*route
+	hasDefault bool
+	// handleError responds to requests matching no route, like the
+	// ErrorHandler of the reverse proxy.
+	handleError func(http.ResponseWriter, *http.Request, error)
+}
+
+func (cfg routeConfig) validate(p *configProblems, configPath string) {
+	if cfg.URL == "" {
+		p.add(configPath+".url", "must not be empty")
+	} else {
+		p.checkUpstreamURL(configPath+".url", cfg.URL)
+	}
+	if cfg.Path != "" {
+		if _, err := path.Match(cfg.Path, "/"); err != nil {
+			p.add(configPath+".path", "invalid path pattern")
+		}
+	}
+	p.checkProxyPath(configPath+".proxy_path", cfg.ProxyPath)
+	if cfg.Canary != nil {
+		cfg.Canary.validate(p, configPath+".canary")
+	}
+}
+
+func newRouter(cfgs []routeConfig, hasDefault bool) (*router, error) {
+	r := &router{hasDefault: hasDefault, handleError: defaultErrorResponder.HandleError}
+	for i, cfg := range cfgs {
+		target, err := parseTargetURL(cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %d: %v", i, err)
+		}
+		canary, err := newCanary(cfg.Canary)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %d: %v", i, err)
+		}
+		r.routes = append(r.routes, &route{routeConfig: cfg, target: target, canary: canary})
+	}
+	return r, nil
+}
+
+// Wrap returns a handler that attaches the first matching route to each
+// request. Requests matching no route are rejected unless there is a
+// default target.
+func (r *router) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, route := range r.routes {
+			if route.matches(req) {
+				next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), routeKey{}, route)))
+				return
+			}
+		}
+		if !r.hasDefault {
+			r.handleError(w, req, errNoRoute)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (r *router) hasCanaries() bool {
+	for _, route := range r.routes {
+		if route.canary != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// routeOf returns the route of req or nil if it has none.
+func routeOf(req *http.Request) *route {
+	r, _ := req.Context().Value(routeKey{}).(*route)
+	return r
+}
+
+// matches reports whether all criteria of the route match req.
+func (r *route) matches(req *http.Request) bool {
+	if r.Path != "" && !matchPath(r.Path, req.URL.Path) {
+		return false
+	}
+	if len(r.Methods) > 0 && !containsFold(r.Methods, req.Method) {
+		return false
+	}
+	if r.Host != "" && !matchHost(r.Host, req.Host) {
+		return false
+	}
+	for name, value := range r.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	if len(r.Query) > 0 {
+		query := req.URL.Query()
+		for name, value := range r.Query {
+			if values, ok := query[name]; !ok || !contains(values, value) {
+				return false
+			}
+		}
+	}
+	for name, value := range r.Cookies {
+		cookie, err := req.Cookie(name)
+		if err != nil || cookie.Value != value {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTargetURL parses the URL of an upstream target, which must be
+// absolute or refer to a unix socket.
+func parseTargetURL(rawURL string) (*url.URL, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	target = resolveUnixSocketURL(target)
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("url must be absolute: %q", rawURL)
+	}
+	return target, nil
+}
+
+// matchPath reports whether p matches pattern. Patterns ending with * match
+// by prefix, all others as described for path.Match.
+func matchPath(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "*") && !strings.HasSuffix(pattern, `\*`) {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if !strings.ContainsAny(prefix, `*?[\`) {
+			return strings.HasPrefix(p, prefix)
+		}
+	}
+	matched, _ := path.Match(pattern, p)
+	return matched
+}
+
+// matchHost reports whether host, ignoring its port, matches pattern.
+// Patterns starting with *. match any subdomain.
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(pattern[1:]))
+	}
+	return strings.EqualFold(host, pattern)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
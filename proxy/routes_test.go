@@ -0,0 +1,178 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Routes", func() {
+	var defaultServer *ghttp.Server
+	var routeServer *ghttp.Server
+	var routesConfig string
+	var defaultURL string
+	var request *http.Request
+	var response *httptest.ResponseRecorder
+
+	BeforeEach(func() {
+		defaultServer = ghttp.NewServer()
+		defaultServer.AllowUnhandledRequests = true
+		defaultServer.UnhandledRequestStatusCode = http.StatusOK
+		routeServer = ghttp.NewServer()
+		routeServer.AllowUnhandledRequests = true
+		routeServer.UnhandledRequestStatusCode = http.StatusAccepted
+		defaultURL = defaultServer.URL()
+
+		var err error
+		request, err = http.NewRequest("GET", "http://api.example.com/v2/users?region=eu", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		response = httptest.NewRecorder()
+	})
+
+	AfterEach(func() {
+		defaultServer.Close()
+		routeServer.Close()
+	})
+
+	JustBeforeEach(func() {
+		config := "url: " + defaultURL + "\nroutes:\n" + routesConfig
+		handler, err := NewHandlerFromRawConfig([]byte(config))
+		Ω(err).ShouldNot(HaveOccurred())
+		handler.ServeHTTP(response, request)
+	})
+
+	itShouldUseRoute := func() {
+		It("should forward the request to the route target", func() {
+			Ω(response.Code).Should(Equal(http.StatusAccepted))
+			Ω(routeServer.ReceivedRequests()).Should(HaveLen(1))
+			Ω(defaultServer.ReceivedRequests()).Should(BeEmpty())
+		})
+	}
+
+	itShouldUseDefault := func() {
+		It("should forward the request to the default target", func() {
+			Ω(response.Code).Should(Equal(http.StatusOK))
+			Ω(defaultServer.ReceivedRequests()).Should(HaveLen(1))
+			Ω(routeServer.ReceivedRequests()).Should(BeEmpty())
+		})
+	}
+
+	Context("when matching on a path prefix", func() {
+		BeforeEach(func() {
+			routesConfig = "- path: /v2/*\n  url: " + routeServer.URL() + "/new\n  proxy_path: /v2\n"
+		})
+
+		itShouldUseRoute()
+
+		It("should apply the proxy path of the route", func() {
+			Ω(routeServer.ReceivedRequests()[0].URL.Path).Should(Equal("/new/users"))
+		})
+
+		Context("and the path does not match", func() {
+			BeforeEach(func() {
+				request.URL.Path = "/v1/users"
+			})
+
+			itShouldUseDefault()
+
+			It("should keep the original path", func() {
+				Ω(defaultServer.ReceivedRequests()[0].URL.Path).Should(Equal("/v1/users"))
+			})
+		})
+	})
+
+	Context("when matching on a header", func() {
+		BeforeEach(func() {
+			routesConfig = "- headers:\n    X-Aker-Tenant: acme\n  url: " + routeServer.URL() + "\n"
+		})
+
+		itShouldUseDefault()
+
+		Context("and the request carries the header", func() {
+			BeforeEach(func() {
+				request.Header.Set("X-Aker-Tenant", "acme")
+			})
+
+			itShouldUseRoute()
+		})
+	})
+
+	Context("when matching on method, host, query and cookie", func() {
+		BeforeEach(func() {
+			routesConfig = "- methods: [GET, HEAD]\n  host: '*.example.com'\n  query:\n    region: eu\n  cookies:\n    beta: \"true\"\n  url: " + routeServer.URL() + "\n"
+			request.AddCookie(&http.Cookie{Name: "beta", Value: "true"})
+		})
+
+		itShouldUseRoute()
+
+		Context("and the cookie does not match", func() {
+			BeforeEach(func() {
+				request.Header.Del("Cookie")
+				request.AddCookie(&http.Cookie{Name: "beta", Value: "false"})
+			})
+
+			itShouldUseDefault()
+		})
+
+		Context("and the method does not match", func() {
+			BeforeEach(func() {
+				request.Method = "POST"
+			})
+
+			itShouldUseDefault()
+		})
+	})
+
+	Context("when several routes match", func() {
+		BeforeEach(func() {
+			routesConfig = "- path: /v2/*\n  url: " + routeServer.URL() + "\n- path: /v2/users\n  url: " + defaultURL + "\n"
+		})
+
+		itShouldUseRoute()
+	})
+
+	Context("when there is no default url", func() {
+		BeforeEach(func() {
+			defaultURL = ""
+			routesConfig = "- path: /v3/*\n  url: " + routeServer.URL() + "\n"
+		})
+
+		It("should respond with not found to unmatched requests", func() {
+			Ω(response.Code).Should(Equal(http.StatusNotFound))
+			Ω(routeServer.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		Context("and error responses are configured", func() {
+			BeforeEach(func() {
+				routesConfig += "error_responses:\n  statuses:\n    no_route: 410\n"
+			})
+
+			It("should respond to unmatched requests through them", func() {
+				Ω(response.Code).Should(Equal(http.StatusGone))
+				Ω(response.Header().Get("Content-Type")).Should(Equal("application/problem+json"))
+				Ω(routeServer.ReceivedRequests()).Should(BeEmpty())
+			})
+		})
+	})
+})
+
+var _ = Describe("Routes configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost\nroutes:\n" + config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail on relative route url", func() {
+		itShouldFail("- path: /v2/*\n  url: /v2\n")
+	})
+
+	It("should fail on invalid path pattern", func() {
+		itShouldFail("- path: /v2/[\n  url: http://localhost\n")
+	})
+})
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"time"
+)
+
+type stickySessionsConfig struct {
+	Cookie       string        `yaml:"cookie"`
+	CookiePath   string        `yaml:"cookie_path"`
+	CookieMaxAge time.Duration `yaml:"cookie_max_age"`
+	CookieSecure bool          `yaml:"cookie_secure"`
+	AppCookie    string        `yaml:"app_cookie"`
+	Header       string        `yaml:"header"`
+	ClientIP     bool          `yaml:"client_ip"`
+}
+
+// sessionAffinity pins sessions to targets. With a proxy-issued cookie,
+// the cookie names the target of the session and is reissued when the
+// target becomes unhealthy. All other session keys are hashed onto the
+// available targets with rendezvous hashing, so that only the sessions of
+// an unhealthy target move to other targets.
+type sessionAffinity struct {
+	stickySessionsConfig
+}
+
+func (cfg stickySessionsConfig) validate(p *configProblems, path string) {
+	if countSet(cfg.Cookie != "", cfg.AppCookie != "", cfg.Header != "", cfg.ClientIP) != 1 {
+		p.add(path, "must set exactly one of cookie, app_cookie, header or client_ip")
+	}
+}
+
+func newSessionAffinity(cfg *stickySessionsConfig) (*sessionAffinity, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	return &sessionAffinity{*cfg}, nil
+}
+
+// pick returns the target the session of req is pinned to or nil if req
+// has no session.
+func (a *sessionAffinity) pick(req *http.Request, targets []*poolTarget) *poolTarget {
+	if a.Cookie != "" {
+		cookie, err := req.Cookie(a.Cookie)
+		if err != nil {
+			return nil
+		}
+		for _, target := range targets {
+			if target.id == cookie.Value {
+				return target
+			}
+		}
+		return nil
+	}
+	key, ok := a.sessionKey(req)
+	if !ok {
+		return nil
+	}
+	return rendezvousTarget(key, targets)
+}
+
+// pin issues the proxy cookie of the session of req if it does not name
+// target yet.
+func (a *sessionAffinity) pin(w http.ResponseWriter, req *http.Request, target *poolTarget) {
+	if a.Cookie == "" {
+		return
+	}
+	if cookie, err := req.Cookie(a.Cookie); err == nil && cookie.Value == target.id {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.Cookie,
+		Value:    target.id,
+		Path:     a.CookiePath,
+		MaxAge:   int(a.CookieMaxAge / time.Second),
+		Secure:   a.CookieSecure,
+		HttpOnly: true,
+	})
+}
+
+func (a *sessionAffinity) sessionKey(req *http.Request) (string, bool) {
+	switch {
+	case a.AppCookie != "":
+		if cookie, err := req.Cookie(a.AppCookie); err == nil && cookie.Value != "" {
+			return cookie.Value, true
+		}
+	case a.Header != "":
+		if value := req.Header.Get(a.Header); value != "" {
+			return value, true
+		}
+	case a.ClientIP:
+		address := clientAddress(req)
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+		return address, address != ""
+	}
+	return "", false
+}
+
+// rendezvousTarget returns the target with the highest hash of key and
+// target id.
+func rendezvousTarget(key string, targets []*poolTarget) *poolTarget {
+	var best *poolTarget
+	var bestScore uint64
+	for _, target := range targets {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte(target.id))
+		if score := hash.Sum64(); best == nil || score > bestScore {
+			best, bestScore = target, score
+		}
+	}
+	return best
+}
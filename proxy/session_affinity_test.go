@@ -0,0 +1,179 @@
+package proxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Sticky sessions", func() {
+	var servers []*ghttp.Server
+	var stickyConfig string
+	var handler http.Handler
+
+	serverOf := func(response *httptest.ResponseRecorder) int {
+		var index int
+		fmt.Sscanf(response.Body.String(), "server-%d", &index)
+		return index
+	}
+
+	serve := func(request *http.Request) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	newRequest := func() *http.Request {
+		request, err := http.NewRequest("GET", "http://example.com/path", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		return request
+	}
+
+	BeforeEach(func() {
+		servers = nil
+		for i := 0; i < 3; i++ {
+			server := ghttp.NewServer()
+			server.AllowUnhandledRequests = true
+			server.RouteToHandler("GET", "/path", ghttp.RespondWith(http.StatusOK, fmt.Sprintf("server-%d", i)))
+			servers = append(servers, server)
+		}
+	})
+
+	AfterEach(func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	})
+
+	JustBeforeEach(func() {
+		config := "targets:\n"
+		for _, server := range servers {
+			config += "- " + server.URL() + "\n"
+		}
+		var err error
+		handler, err = NewHandlerFromRawConfig([]byte(config + "sticky_sessions:\n" + stickyConfig))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	Context("when using a proxy cookie", func() {
+		BeforeEach(func() {
+			stickyConfig = "  cookie: AKER_AFFINITY\n"
+		})
+
+		It("should pin the session to a target", func() {
+			response := serve(newRequest())
+			cookies := (&http.Response{Header: response.Header()}).Cookies()
+			Ω(cookies).Should(HaveLen(1))
+			Ω(cookies[0].Name).Should(Equal("AKER_AFFINITY"))
+			Ω(cookies[0].HttpOnly).Should(BeTrue())
+			server := serverOf(response)
+
+			for i := 0; i < 5; i++ {
+				request := newRequest()
+				request.AddCookie(cookies[0])
+				response := serve(request)
+				Ω(serverOf(response)).Should(Equal(server))
+				Ω(response.Header().Get("Set-Cookie")).Should(BeEmpty())
+			}
+		})
+
+		Context("and the pinned target becomes unhealthy", func() {
+			It("should move the session to another target", func() {
+				response := serve(newRequest())
+				cookie := (&http.Response{Header: response.Header()}).Cookies()[0]
+				server := serverOf(response)
+				servers[server].Close()
+				servers[server] = ghttp.NewServer()
+
+				request := newRequest()
+				request.AddCookie(cookie)
+				Ω(serve(request).Code).Should(Equal(http.StatusBadGateway))
+
+				request = newRequest()
+				request.AddCookie(cookie)
+				response = serve(request)
+				Ω(response.Code).Should(Equal(http.StatusOK))
+				Ω(serverOf(response)).ShouldNot(Equal(server))
+				newCookie := (&http.Response{Header: response.Header()}).Cookies()[0]
+				Ω(newCookie.Value).ShouldNot(Equal(cookie.Value))
+			})
+		})
+
+		Context("and the request goes to a canary", func() {
+			var canaryServer *ghttp.Server
+
+			BeforeEach(func() {
+				canaryServer = ghttp.NewServer()
+				canaryServer.AllowUnhandledRequests = true
+				canaryServer.UnhandledRequestStatusCode = http.StatusAccepted
+				stickyConfig += "canary:\n  url: " + canaryServer.URL() + "\n  weight: 100\n"
+			})
+
+			AfterEach(func() {
+				canaryServer.Close()
+			})
+
+			It("should not pin the session", func() {
+				response := serve(newRequest())
+				Ω(response.Code).Should(Equal(http.StatusAccepted))
+				Ω(response.Header().Get("Set-Cookie")).Should(BeEmpty())
+				for _, server := range servers {
+					Ω(server.ReceivedRequests()).Should(BeEmpty())
+				}
+			})
+		})
+	})
+
+	Context("when using a header", func() {
+		BeforeEach(func() {
+			stickyConfig = "  header: X-Aker-User-Id\n"
+		})
+
+		It("should keep each user on the same target", func() {
+			used := map[int]bool{}
+			for user := 0; user < 20; user++ {
+				request := newRequest()
+				request.Header.Set("X-Aker-User-Id", fmt.Sprintf("user-%d", user))
+				server := serverOf(serve(request))
+				used[server] = true
+				for i := 0; i < 3; i++ {
+					request := newRequest()
+					request.Header.Set("X-Aker-User-Id", fmt.Sprintf("user-%d", user))
+					Ω(serverOf(serve(request))).Should(Equal(server))
+				}
+			}
+			Ω(used).Should(HaveLen(3))
+		})
+	})
+
+	Context("when using an application cookie", func() {
+		BeforeEach(func() {
+			stickyConfig = "  app_cookie: JSESSIONID\n"
+		})
+
+		It("should keep the session on the same target", func() {
+			request := newRequest()
+			request.AddCookie(&http.Cookie{Name: "JSESSIONID", Value: "session"})
+			server := serverOf(serve(request))
+			for i := 0; i < 3; i++ {
+				request := newRequest()
+				request.AddCookie(&http.Cookie{Name: "JSESSIONID", Value: "session"})
+				Ω(serverOf(serve(request))).Should(Equal(server))
+			}
+		})
+	})
+})
+
+var _ = Describe("Sticky sessions configuration", func() {
+	It("should fail on several session keys", func() {
+		handler, err := NewHandlerFromRawConfig([]byte("targets: [http://localhost]\nsticky_sessions:\n  header: X-User\n  client_ip: true\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	})
+})
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SAP/gologger"
+)
+
+const (
+	defaultMaxFailures    = 1
+	defaultHealthCooldown = 10 * time.Second
+)
+
+var errNoTargetAvailable = errors.New("no target is available")
+
+type healthConfig struct {
+	MaxFailures int           `yaml:"max_failures"`
+	Cooldown    time.Duration `yaml:"cooldown"`
+}
+
+type poolTargetKey struct{}
+
+// poolTarget is one of the targets of a targetPool. Targets are considered
+// unhealthy for a cooldown period after a number of consecutive failed
+// round trips. The host of a target is sent in the Host header and, if
+// serverName is set, verified in the TLS handshake instead of the host of
+// its URL.
+type poolTarget struct {
+	url            *url.URL
+	host           string
+	serverName     string
+	id             string
+	failures       int32
+	unhealthyUntil int64
+	inFlight       int64
+}
+
+func newPoolTarget(target *url.URL) *poolTarget {
+	hash := sha1.Sum([]byte(target.String()))
+	return &poolTarget{url: target, host: upstreamHost(target), id: hex.EncodeToString(hash[:8])}
+}
+
+func (t *poolTarget) healthy(now time.Time) bool {
+	return atomic.LoadInt64(&t.unhealthyUntil) <= now.UnixNano()
+}
+
+// targetPool holds the targets requests without a route are balanced
+// across.
+type targetPool struct {
+	mutex       sync.RWMutex
+	targets     []*poolTarget
+	counter     uint32
+	maxFailures int32
+	cooldown    time.Duration
+	affinity    *sessionAffinity
+	balancer    *hashBalancer
+	table       hashTable
+	// handleError responds to requests without available target, like
+	// the ErrorHandler of the reverse proxy.
+	handleError func(http.ResponseWriter, *http.Request, error)
+
+	transportMutex sync.Mutex
+	transports     map[string]*http.Transport
+}
+
+func (cfg healthConfig) validate(p *configProblems, path string) {
+	if cfg.MaxFailures < 0 {
+		p.add(path+".max_failures", "must not be negative")
+	}
+}
+
+func newTargetPool(rawURLs []string, health *healthConfig, affinity *sessionAffinity, balancer *hashBalancer) (*targetPool, error) {
+	pool := &targetPool{
+		maxFailures: int32(health.MaxFailures),
+		cooldown:    health.Cooldown,
+		affinity:    affinity,
+		balancer:    balancer,
+		handleError: defaultErrorResponder.HandleError,
+	}
+	targets, err := parsePoolTargets(rawURLs)
+	if err != nil {
+		return nil, err
+	}
+	pool.setTargets(targets)
+	return pool, nil
+}
+
+func parsePoolTargets(rawURLs []string) ([]*poolTarget, error) {
+	var targets []*poolTarget
+	for i, rawURL := range rawURLs {
+		target, err := parseTargetURL(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %d: %v", i, err)
+		}
+		targets = append(targets, newPoolTarget(target))
+	}
+	return targets, nil
+}
+
+// update replaces the targets of the pool. Targets that stay in the pool
+// keep their health state, and requests in flight to removed targets
+// complete on them.
+func (p *targetPool) update(targets []*poolTarget) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	existing := make(map[string]*poolTarget, len(p.targets))
+	for _, target := range p.targets {
+		existing[target.id] = target
+	}
+	updated := make([]*poolTarget, 0, len(targets))
+	added := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		if added[target.id] {
+			continue
+		}
+		added[target.id] = true
+		if known, ok := existing[target.id]; ok {
+			target = known
+		}
+		updated = append(updated, target)
+	}
+	p.setTargets(updated)
+}
+
+// setTargets sets the targets of the pool and builds the hash table of the
+// balancer for them. The caller must hold the mutex for writing.
+func (p *targetPool) setTargets(targets []*poolTarget) {
+	p.targets = targets
+	if p.balancer != nil {
+		p.table = p.balancer.build(targets)
+	}
+}
+
+// available returns the healthy targets or, if there are none, all
+// targets, as failing fast would not help clients either. It also returns
+// the hash table of the pool and whether all targets are returned.
+func (p *targetPool) available() ([]*poolTarget, hashTable, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	now := time.Now()
+	healthy := make([]*poolTarget, 0, len(p.targets))
+	for _, target := range p.targets {
+		if target.healthy(now) {
+			healthy = append(healthy, target)
+		}
+	}
+	if len(healthy) == 0 {
+		return p.targets, p.table, true
+	}
+	return healthy, p.table, len(healthy) == len(p.targets)
+}
+
+// pick chooses the target of req, preferring the target the session of req
+// is pinned to. Requests without session are assigned by their hash key if
+// there is a hash balancer, and in round robin order otherwise.
+func (p *targetPool) pick(req *http.Request) *poolTarget {
+	targets, table, all := p.available()
+	if len(targets) == 0 {
+		return nil
+	}
+	if p.affinity != nil {
+		if target := p.affinity.pick(req, targets); target != nil {
+			return target
+		}
+	}
+	if p.balancer != nil {
+		now := time.Now()
+		available := func(target *poolTarget) bool { return all || target.healthy(now) }
+		if target := p.balancer.pick(req, table, targets, available); target != nil {
+			return target
+		}
+	}
+	return targets[atomic.AddUint32(&p.counter, 1)%uint32(len(targets))]
+}
+
+// Wrap returns a handler that attaches a target of the pool to requests
+// without a route that do not go to a canary.
+func (p *targetPool) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if routeOf(req) != nil || canaryTargetOf(req) != nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		target := p.pick(req)
+		if target == nil {
+			p.handleError(w, req, errNoTargetAvailable)
+			return
+		}
+		if p.affinity != nil {
+			p.affinity.pin(w, req, target)
+		}
+		atomic.AddInt64(&target.inFlight, 1)
+		defer atomic.AddInt64(&target.inFlight, -1)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), poolTargetKey{}, target)))
+	})
+}
+
+// WrapTransport returns a round tripper that tracks the health of the
+// targets of the requests sent through next.
+func (p *targetPool) WrapTransport(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		target := poolTargetOf(req)
+		if target == nil || target.url.Host != req.URL.Host {
+			return next.RoundTrip(req)
+		}
+		resp, err := p.transportFor(next, target).RoundTrip(req)
+		if err != nil {
+			p.recordFailure(target, err)
+		} else {
+			atomic.StoreInt32(&target.failures, 0)
+		}
+		return resp, err
+	})
+}
+
+// transportFor returns the round tripper for target, which verifies the
+// server name of target if next is a transport and target has one.
+func (p *targetPool) transportFor(next http.RoundTripper, target *poolTarget) http.RoundTripper {
+	base, ok := next.(*http.Transport)
+	if !ok || target.serverName == "" {
+		return next
+	}
+	p.transportMutex.Lock()
+	defer p.transportMutex.Unlock()
+	transport, ok := p.transports[target.serverName]
+	if !ok {
+		transport = base.Clone()
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.ServerName = target.serverName
+		if p.transports == nil {
+			p.transports = make(map[string]*http.Transport)
+		}
+		p.transports[target.serverName] = transport
+	}
+	return transport
+}
+
+// closeTransportsOnStop closes the idle connections of the transports
+// created for the server names of targets once stop is closed.
+func (p *targetPool) closeTransportsOnStop(stop <-chan struct{}) {
+	go func() {
+		<-stop
+		p.transportMutex.Lock()
+		defer p.transportMutex.Unlock()
+		for _, transport := range p.transports {
+			transport.CloseIdleConnections()
+		}
+	}()
+}
+
+func (p *targetPool) recordFailure(target *poolTarget, err error) {
+	switch classifyError(err) {
+	case errorClassConnectionRefused, errorClassDNSFailure, errorClassTimeout, errorClassTLSError:
+	default:
+		return
+	}
+	if atomic.AddInt32(&target.failures, 1) < p.maxFailures {
+		return
+	}
+	atomic.StoreInt32(&target.failures, 0)
+	atomic.StoreInt64(&target.unhealthyUntil, time.Now().Add(p.cooldown).UnixNano())
+	gologger.Warnf("Target %s is unhealthy for %s: %v", target.url.Host, p.cooldown, err)
+}
+
+// poolTargetOf returns the pool target chosen for req or nil if there is
+// none.
+func poolTargetOf(req *http.Request) *poolTarget {
+	target, _ := req.Context().Value(poolTargetKey{}).(*poolTarget)
+	return target
+}
@@ -0,0 +1,90 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Targets", func() {
+	var firstServer *ghttp.Server
+	var secondServer *ghttp.Server
+	var handler http.Handler
+
+	serve := func() *httptest.ResponseRecorder {
+		request, err := http.NewRequest("GET", "http://example.com/path", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	BeforeEach(func() {
+		firstServer = ghttp.NewServer()
+		firstServer.AllowUnhandledRequests = true
+		firstServer.UnhandledRequestStatusCode = http.StatusOK
+		secondServer = ghttp.NewServer()
+		secondServer.AllowUnhandledRequests = true
+		secondServer.UnhandledRequestStatusCode = http.StatusOK
+
+		var err error
+		handler, err = NewHandlerFromRawConfig([]byte("targets:\n- " + firstServer.URL() + "\n- " + secondServer.URL() + "\nhealth:\n  max_failures: 1\n  cooldown: 1m\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		firstServer.Close()
+		secondServer.Close()
+	})
+
+	It("should balance requests across the targets", func() {
+		for i := 0; i < 4; i++ {
+			Ω(serve().Code).Should(Equal(http.StatusOK))
+		}
+		Ω(firstServer.ReceivedRequests()).Should(HaveLen(2))
+		Ω(secondServer.ReceivedRequests()).Should(HaveLen(2))
+	})
+
+	Context("when a target fails", func() {
+		BeforeEach(func() {
+			firstServer.Close()
+			firstServer = ghttp.NewServer()
+		})
+
+		It("should stop sending requests to the target", func() {
+			failures := 0
+			for i := 0; i < 5; i++ {
+				if serve().Code != http.StatusOK {
+					failures++
+				}
+			}
+			Ω(failures).Should(BeNumerically("<=", 1))
+			Ω(len(secondServer.ReceivedRequests())).Should(BeNumerically(">=", 4))
+		})
+	})
+})
+
+var _ = Describe("Targets configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte(config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail on url and targets", func() {
+		itShouldFail("url: http://localhost\ntargets: [http://localhost:8080]\n")
+	})
+
+	It("should fail on relative targets", func() {
+		itShouldFail("targets: [localhost:8080]\n")
+	})
+
+	It("should fail on health without targets", func() {
+		itShouldFail("url: http://localhost\nhealth:\n  max_failures: 3\n")
+	})
+})
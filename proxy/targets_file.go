@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/SAP/gologger"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultTargetsFilePollInterval = 5 * time.Second
+
+type targetsFileConfig struct {
+	Path         string        `yaml:"path"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// targetsFile keeps the targets of a pool in sync with a JSON or YAML file
+// listing target URLs. The file is read every poll interval, and targets
+// are replaced whenever its contents change. Invalid contents are logged
+// and ignored, so that the targets read last stay in use.
+type targetsFile struct {
+	path         string
+	pollInterval time.Duration
+	pool         *targetPool
+	contents     []byte
+	readErr      string
+}
+
+// readTargetsFile returns the target URLs listed in the file at path and
+// the contents of the file.
+func readTargetsFile(path string) ([]string, []byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	targets, err := parseTargetsFile(contents)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid targets file %s: %v", path, err)
+	}
+	return targets, contents, nil
+}
+
+// parseTargetsFile accepts a list of target URLs or a document with such a
+// list as targets. The URLs are checked like the targets of the
+// configuration.
+func parseTargetsFile(contents []byte) ([]string, error) {
+	var targets []string
+	if err := yaml.Unmarshal(contents, &targets); err != nil {
+		var document struct {
+			Targets []string `yaml:"targets"`
+		}
+		if err := yaml.Unmarshal(contents, &document); err != nil {
+			return nil, err
+		}
+		targets = document.Targets
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets listed")
+	}
+	var problems configProblems
+	for i, target := range targets {
+		problems.checkUpstreamURL(fmt.Sprintf("targets[%d]", i), target)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return targets, nil
+}
+
+// watchTargetsFile updates the targets of pool when the file of cfg
+// changes until stop is closed. contents are the contents pool was created
+// from.
+func watchTargetsFile(cfg *targetsFileConfig, pool *targetPool, contents []byte, stop <-chan struct{}) error {
+	f := &targetsFile{
+		path:         cfg.Path,
+		pollInterval: cfg.PollInterval,
+		pool:         pool,
+		contents:     contents,
+	}
+	go f.run(stop)
+	return nil
+}
+
+func (f *targetsFile) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(f.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.reload()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (f *targetsFile) reload() {
+	contents, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		if err.Error() != f.readErr {
+			gologger.Warnf("Reading targets file failed, keeping targets: %v", err)
+			f.readErr = err.Error()
+		}
+		return
+	}
+	f.readErr = ""
+	if bytes.Equal(contents, f.contents) {
+		return
+	}
+	f.contents = contents
+
+	rawURLs, err := parseTargetsFile(contents)
+	if err != nil {
+		gologger.Errorf("Ignoring invalid targets file %s, keeping targets: %v", f.path, err)
+		return
+	}
+	targets, err := parsePoolTargets(rawURLs)
+	if err != nil {
+		gologger.Errorf("Ignoring invalid targets file %s, keeping targets: %v", f.path, err)
+		return
+	}
+	f.pool.update(targets)
+	gologger.Infof("Updated targets from %s to %d targets", f.path, len(targets))
+}
@@ -0,0 +1,144 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Targets file", func() {
+	var dir string
+	var path string
+	var firstServer *ghttp.Server
+	var secondServer *ghttp.Server
+	var handler http.Handler
+
+	serve := func() *httptest.ResponseRecorder {
+		request, err := http.NewRequest("GET", "http://example.com/path", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	writeTargets := func(contents string) {
+		Ω(ioutil.WriteFile(path, []byte(contents), 0644)).Should(Succeed())
+	}
+
+	// sentOnlyTo returns whether the next requests are all sent to server.
+	sentOnlyTo := func(server *ghttp.Server) func() bool {
+		return func() bool {
+			received := len(server.ReceivedRequests())
+			for i := 0; i < 4; i++ {
+				Ω(serve().Code).Should(Equal(http.StatusOK))
+			}
+			return len(server.ReceivedRequests())-received == 4
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "targets")
+		Ω(err).ShouldNot(HaveOccurred())
+		path = filepath.Join(dir, "targets.yml")
+
+		firstServer = ghttp.NewServer()
+		firstServer.AllowUnhandledRequests = true
+		firstServer.UnhandledRequestStatusCode = http.StatusOK
+		secondServer = ghttp.NewServer()
+		secondServer.AllowUnhandledRequests = true
+		secondServer.UnhandledRequestStatusCode = http.StatusOK
+
+		writeTargets("- " + firstServer.URL() + "\n")
+		handler, err = NewHandlerFromRawConfig([]byte("targets_file:\n  path: " + path + "\n  poll_interval: 10ms\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		firstServer.Close()
+		secondServer.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should send requests to the listed targets", func() {
+		Ω(sentOnlyTo(firstServer)()).Should(BeTrue())
+	})
+
+	It("should replace the targets when the file changes", func() {
+		writeTargets(`{"targets": ["` + secondServer.URL() + `"]}`)
+		Eventually(sentOnlyTo(secondServer)).Should(BeTrue())
+	})
+
+	It("should keep the targets when the file is invalid", func() {
+		writeTargets("- " + secondServer.URL() + "\n- localhost:8080\n")
+		Consistently(sentOnlyTo(firstServer), "100ms").Should(BeTrue())
+		writeTargets("targets: {")
+		Consistently(sentOnlyTo(firstServer), "100ms").Should(BeTrue())
+		writeTargets("- " + secondServer.URL() + "\n- ftp://localhost\n")
+		Consistently(sentOnlyTo(firstServer), "100ms").Should(BeTrue())
+	})
+
+	It("should complete requests in flight to removed targets", func() {
+		release := make(chan struct{})
+		firstServer.RouteToHandler("GET", "/slow", func(w http.ResponseWriter, req *http.Request) {
+			<-release
+		})
+		done := make(chan int)
+		go func() {
+			defer GinkgoRecover()
+			request, _ := http.NewRequest("GET", "http://example.com/slow", nil)
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			done <- response.Code
+		}()
+		Eventually(firstServer.ReceivedRequests).Should(HaveLen(1))
+
+		writeTargets("- " + secondServer.URL() + "\n")
+		Eventually(sentOnlyTo(secondServer)).Should(BeTrue())
+		close(release)
+		Eventually(done).Should(Receive(Equal(http.StatusOK)))
+	})
+})
+
+var _ = Describe("Targets file configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte(config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail on missing file", func() {
+		itShouldFail("targets_file:\n  path: /does/not/exist.yml\n")
+	})
+
+	It("should fail on targets file and url", func() {
+		itShouldFail("url: http://localhost\ntargets_file:\n  path: /does/not/exist.yml\n")
+	})
+
+	It("should fail on targets with unsupported scheme", func() {
+		file, err := ioutil.TempFile("", "targets")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(file.Name())
+		file.WriteString("- ftp://localhost\n")
+		file.Close()
+		_, err = NewHandlerFromRawConfig([]byte("targets_file:\n  path: " + file.Name() + "\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("targets[0]: scheme must be http, https or unix"))
+	})
+
+	It("should fail on file without targets", func() {
+		file, err := ioutil.TempFile("", "targets")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(file.Name())
+		file.Close()
+		itShouldFail("targets_file:\n  path: " + file.Name() + "\n")
+	})
+})
@@ -0,0 +1,490 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SAP/gologger"
+)
+
+const (
+	defaultTracingServiceName  = "aker-proxy-plugin"
+	defaultTracingBatchTimeout = 5 * time.Second
+	defaultTracingBatchSize    = 512
+	tracingQueueSize           = 2048
+	tracingScopeName           = "github.com/SAP/aker-proxy-plugin/proxy"
+)
+
+// Trace context propagation formats.
+const (
+	propagatorTraceContext = "tracecontext"
+	propagatorB3           = "b3"
+)
+
+// OTLP span kind and status codes.
+const (
+	otlpSpanKindClient  = 3
+	otlpStatusCodeUnset = 0
+	otlpStatusCodeError = 2
+)
+
+type tracingConfig struct {
+	Endpoint     string            `yaml:"endpoint"`
+	Headers      map[string]string `yaml:"headers"`
+	ServiceName  string            `yaml:"service_name"`
+	SampleRatio  *float64          `yaml:"sample_ratio"`
+	Propagators  []string          `yaml:"propagators"`
+	BatchTimeout time.Duration     `yaml:"batch_timeout"`
+	BatchSize    int               `yaml:"batch_size"`
+}
+
+// spanContext identifies a span within a trace.
+type spanContext struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	sampled    bool
+	traceState string
+}
+
+// tracer creates a client span for each upstream round trip and propagates
+// the trace context to the upstream.
+type tracer struct {
+	exporter      *spanExporter
+	sampleRatio   float64
+	samplingBound uint64
+	traceContext  bool
+	b3            bool
+}
+
+func (cfg tracingConfig) validate(p *configProblems, path string) {
+	if cfg.Endpoint == "" {
+		p.add(path+".endpoint", "must not be empty")
+	} else if endpoint, err := url.Parse(cfg.Endpoint); err != nil {
+		p.add(path+".endpoint", "%v", err)
+	} else if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		p.add(path+".endpoint", "must be a http or https URL")
+	}
+	p.checkRatio(path+".sample_ratio", cfg.SampleRatio)
+	for i, propagator := range cfg.Propagators {
+		if propagator != propagatorTraceContext && propagator != propagatorB3 {
+			p.add(fmt.Sprintf("%s.propagators[%d]", path, i), "unknown tracing propagator %q", propagator)
+		}
+	}
+}
+
+// newTracer returns a tracer whose spans are exported until stop is closed.
+func newTracer(cfg tracingConfig, stop <-chan struct{}) (*tracer, error) {
+	t := &tracer{sampleRatio: *cfg.SampleRatio}
+	if t.sampleRatio < 1 {
+		t.samplingBound = uint64(t.sampleRatio * math.MaxUint64)
+	}
+
+	for _, propagator := range cfg.Propagators {
+		switch propagator {
+		case propagatorTraceContext:
+			t.traceContext = true
+		case propagatorB3:
+			t.b3 = true
+		default:
+			return nil, fmt.Errorf("unknown tracing propagator: %q", propagator)
+		}
+	}
+
+	t.exporter = newSpanExporter(cfg)
+	go t.exporter.run(stop)
+	return t, nil
+}
+
+// WrapTransport returns a round tripper that traces the requests sent
+// through next. The trace headers are injected here rather than in the
+// Director, so that removing internal headers can not strip them.
+func (t *tracer) WrapTransport(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		parent, hasParent := t.extract(req.Header)
+		span := t.startSpan(parent, hasParent)
+		span.name = "HTTP " + req.Method
+		span.attributes = map[string]interface{}{
+			"http.request.method": req.Method,
+			"url.full":            redactQuery(req.URL),
+			"server.address":      req.URL.Hostname(),
+			"aker.request_id":     requestID(req),
+		}
+		if port := req.URL.Port(); port != "" {
+			if value, err := strconv.Atoi(port); err == nil {
+				span.attributes["server.port"] = value
+			}
+		}
+
+		req = cloneRequestHeader(req)
+		t.inject(req.Header, span.context)
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			span.attributes["error.type"] = classifyError(err)
+			span.statusMessage = err.Error()
+			t.endSpan(span)
+			return nil, err
+		}
+		span.attributes["http.response.status_code"] = resp.StatusCode
+		if resp.StatusCode >= 500 {
+			span.attributes["error.type"] = strconv.Itoa(resp.StatusCode)
+		}
+		resp.Body = &tracedBody{ReadCloser: resp.Body, end: func() { t.endSpan(span) }}
+		return resp, nil
+	})
+}
+
+func (t *tracer) startSpan(parent spanContext, hasParent bool) *span {
+	s := &span{start: time.Now()}
+	if hasParent {
+		s.context.traceID = parent.traceID
+		s.context.sampled = parent.sampled
+		s.context.traceState = parent.traceState
+		s.parentSpanID = parent.spanID
+		s.hasParent = true
+	} else {
+		rand.Read(s.context.traceID[:])
+		s.context.sampled = t.sampleRatio >= 1 || binary.BigEndian.Uint64(s.context.traceID[8:]) < t.samplingBound
+	}
+	rand.Read(s.context.spanID[:])
+	return s
+}
+
+func (t *tracer) endSpan(s *span) {
+	s.once.Do(func() {
+		if !s.context.sampled {
+			return
+		}
+		s.end = time.Now()
+		t.exporter.export(s)
+	})
+}
+
+func (t *tracer) extract(header http.Header) (spanContext, bool) {
+	if t.traceContext {
+		if ctx, ok := parseTraceParent(header.Get("Traceparent")); ok {
+			ctx.traceState = header.Get("Tracestate")
+			return ctx, true
+		}
+	}
+	if t.b3 {
+		if ctx, ok := parseB3Single(header.Get("B3")); ok {
+			return ctx, true
+		}
+		if ctx, ok := parseB3Multi(header); ok {
+			return ctx, true
+		}
+	}
+	return spanContext{}, false
+}
+
+func (t *tracer) inject(header http.Header, ctx spanContext) {
+	traceID := hex.EncodeToString(ctx.traceID[:])
+	spanID := hex.EncodeToString(ctx.spanID[:])
+	sampled := "0"
+	if ctx.sampled {
+		sampled = "1"
+	}
+	if t.traceContext {
+		header.Set("Traceparent", "00-"+traceID+"-"+spanID+"-0"+sampled)
+		if ctx.traceState != "" {
+			header.Set("Tracestate", ctx.traceState)
+		}
+	}
+	if t.b3 {
+		header.Del("B3")
+		header.Del("X-B3-ParentSpanId")
+		header.Del("X-B3-Flags")
+		header.Set("X-B3-TraceId", traceID)
+		header.Set("X-B3-SpanId", spanID)
+		header.Set("X-B3-Sampled", sampled)
+	}
+}
+
+// cloneRequestHeader returns a shallow copy of req with its own header, as
+// round trippers must not modify the request they are given.
+func cloneRequestHeader(req *http.Request) *http.Request {
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		clone.Header[name] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+func parseTraceParent(value string) (spanContext, bool) {
+	var ctx spanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return ctx, false
+	}
+	if !decodeID(ctx.traceID[:], parts[1]) || !decodeID(ctx.spanID[:], parts[2]) || len(parts[3]) != 2 {
+		return ctx, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return ctx, false
+	}
+	ctx.sampled = flags[0]&1 == 1
+	return ctx, true
+}
+
+func parseB3Single(value string) (spanContext, bool) {
+	var ctx spanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 2 {
+		return ctx, false
+	}
+	if !decodeID(ctx.traceID[:], padTraceID(parts[0])) || !decodeID(ctx.spanID[:], parts[1]) {
+		return ctx, false
+	}
+	ctx.sampled = len(parts) < 3 || parts[2] == "1" || parts[2] == "d"
+	return ctx, true
+}
+
+func parseB3Multi(header http.Header) (spanContext, bool) {
+	var ctx spanContext
+	if !decodeID(ctx.traceID[:], padTraceID(header.Get("X-B3-TraceId"))) || !decodeID(ctx.spanID[:], header.Get("X-B3-SpanId")) {
+		return ctx, false
+	}
+	sampled := header.Get("X-B3-Sampled")
+	ctx.sampled = sampled == "" || sampled == "1" || strings.EqualFold(sampled, "true") || header.Get("X-B3-Flags") == "1"
+	return ctx, true
+}
+
+// padTraceID extends 64-bit B3 trace ids to 128 bits.
+func padTraceID(id string) string {
+	if len(id) == 16 {
+		return strings.Repeat("0", 16) + id
+	}
+	return id
+}
+
+func decodeID(dst []byte, value string) bool {
+	if len(value) != 2*len(dst) {
+		return false
+	}
+	if _, err := hex.Decode(dst, []byte(value)); err != nil {
+		return false
+	}
+	for _, b := range dst {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type span struct {
+	context       spanContext
+	parentSpanID  [8]byte
+	hasParent     bool
+	name          string
+	start         time.Time
+	end           time.Time
+	attributes    map[string]interface{}
+	statusMessage string
+	once          sync.Once
+}
+
+// tracedBody ends the span of a round trip once the response body has been
+// read completely or closed.
+type tracedBody struct {
+	io.ReadCloser
+	end func()
+}
+
+func (b *tracedBody) Read(data []byte) (int, error) {
+	n, err := b.ReadCloser.Read(data)
+	if err != nil {
+		b.end()
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	b.end()
+	return b.ReadCloser.Close()
+}
+
+// spanExporter sends spans in batches to an OTLP/HTTP collector using the
+// JSON encoding. Spans are dropped when the queue is full, so that a slow
+// collector can not slow down proxied requests.
+type spanExporter struct {
+	endpoint     string
+	headers      map[string]string
+	serviceName  string
+	batchTimeout time.Duration
+	batchSize    int
+	queue        chan *span
+	client       *http.Client
+}
+
+func newSpanExporter(cfg tracingConfig) *spanExporter {
+	return &spanExporter{
+		endpoint:     cfg.Endpoint,
+		headers:      cfg.Headers,
+		serviceName:  cfg.ServiceName,
+		batchTimeout: cfg.BatchTimeout,
+		batchSize:    cfg.BatchSize,
+		queue:        make(chan *span, tracingQueueSize),
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *spanExporter) export(s *span) {
+	select {
+	case e.queue <- s:
+	default:
+		gologger.Warnf("Dropping span of trace %x, export queue is full", s.context.traceID)
+	}
+}
+
+// run exports the queued spans in batches until stop is closed, when the
+// spans queued so far are exported a last time.
+func (e *spanExporter) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(e.batchTimeout)
+	defer ticker.Stop()
+	batch := make([]*span, 0, e.batchSize)
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < e.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-stop:
+			e.flush(batch)
+			return
+		}
+		e.sendBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush exports batch and the spans left in the queue.
+func (e *spanExporter) flush(batch []*span) {
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < e.batchSize {
+				continue
+			}
+		default:
+			if len(batch) > 0 {
+				e.sendBatch(batch)
+			}
+			return
+		}
+		e.sendBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+func (e *spanExporter) sendBatch(batch []*span) {
+	if err := e.send(batch); err != nil {
+		gologger.Errorf("Error exporting %d spans: %v", len(batch), err)
+	}
+}
+
+func (e *spanExporter) send(batch []*span) error {
+	spans := make([]interface{}, len(batch))
+	for i, s := range batch {
+		spans[i] = otlpSpan(s)
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": e.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": tracingScopeName},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func otlpSpan(s *span) map[string]interface{} {
+	status := map[string]interface{}{"code": otlpStatusCodeUnset}
+	if _, failed := s.attributes["error.type"]; failed {
+		status = map[string]interface{}{"code": otlpStatusCodeError, "message": s.statusMessage}
+	}
+	result := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.context.traceID[:]),
+		"spanId":            hex.EncodeToString(s.context.spanID[:]),
+		"name":              s.name,
+		"kind":              otlpSpanKindClient,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+		"status":            status,
+	}
+	if s.hasParent {
+		result["parentSpanId"] = hex.EncodeToString(s.parentSpanID[:])
+	}
+	if s.context.traceState != "" {
+		result["traceState"] = s.context.traceState
+	}
+	return result
+}
+
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	result := make([]interface{}, 0, len(attributes))
+	for key, value := range attributes {
+		var otlpValue map[string]interface{}
+		switch v := value.(type) {
+		case int:
+			otlpValue = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		default:
+			otlpValue = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]interface{}{"key": key, "value": otlpValue})
+	}
+	return result
+}
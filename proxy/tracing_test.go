@@ -0,0 +1,181 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Tracing", func() {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentSpanID = "00f067aa0ba902b7"
+
+	var fakeServer *ghttp.Server
+	var collector *httptest.Server
+	var collectorMutex sync.Mutex
+	var exported []string
+	var request *http.Request
+	var response *httptest.ResponseRecorder
+	var upstreamHeader http.Header
+
+	exportedPayloads := func() string {
+		collectorMutex.Lock()
+		defer collectorMutex.Unlock()
+		return strings.Join(exported, "\n")
+	}
+
+	BeforeEach(func() {
+		exported = nil
+		collector = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			collectorMutex.Lock()
+			exported = append(exported, string(body))
+			collectorMutex.Unlock()
+		}))
+
+		fakeServer = ghttp.NewServer()
+		fakeServer.AppendHandlers(func(w http.ResponseWriter, req *http.Request) {
+			upstreamHeader = req.Header
+			w.Write([]byte("content"))
+		})
+		response = httptest.NewRecorder()
+		var err error
+		request, err = http.NewRequest("GET", "http://example.com/", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		request.Header.Set("X-Aker-Request-Id", "some-request-id")
+	})
+
+	AfterEach(func() {
+		fakeServer.Close()
+		collector.Close()
+	})
+
+	JustBeforeEach(func() {
+		config := "url: " + fakeServer.URL() + "\ntracing:\n  endpoint: " + collector.URL + "/v1/traces\n  batch_timeout: 10ms\n"
+		handler, err := NewHandlerFromRawConfig([]byte(config))
+		Ω(err).ShouldNot(HaveOccurred())
+		handler.ServeHTTP(response, request)
+	})
+
+	Context("when the request carries a W3C trace context", func() {
+		BeforeEach(func() {
+			request.Header.Set("Traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+			request.Header.Set("Tracestate", "vendor=value")
+		})
+
+		It("should propagate the trace to the upstream", func() {
+			Ω(response.Code).Should(Equal(http.StatusOK))
+			Ω(upstreamHeader.Get("Traceparent")).Should(HavePrefix("00-" + traceID + "-"))
+			Ω(upstreamHeader.Get("Traceparent")).ShouldNot(ContainSubstring(parentSpanID))
+			Ω(upstreamHeader.Get("Tracestate")).Should(Equal("vendor=value"))
+			Ω(upstreamHeader.Get("X-B3-TraceId")).Should(Equal(traceID))
+		})
+
+		It("should export a client span", func() {
+			Eventually(exportedPayloads).Should(ContainSubstring(traceID))
+
+			var payload struct {
+				ResourceSpans []struct {
+					ScopeSpans []struct {
+						Spans []map[string]interface{}
+					}
+				}
+			}
+			Ω(json.Unmarshal([]byte(exported[0]), &payload)).Should(Succeed())
+			span := payload.ResourceSpans[0].ScopeSpans[0].Spans[0]
+			Ω(span).Should(HaveKeyWithValue("traceId", traceID))
+			Ω(span).Should(HaveKeyWithValue("parentSpanId", parentSpanID))
+			Ω(span).Should(HaveKeyWithValue("kind", BeNumerically("==", 3)))
+			Ω(exported[0]).Should(ContainSubstring(`"key":"aker.request_id","value":{"stringValue":"some-request-id"}`))
+		})
+	})
+
+	Context("when the request carries a B3 trace context", func() {
+		BeforeEach(func() {
+			request.Header.Set("X-B3-TraceId", traceID)
+			request.Header.Set("X-B3-SpanId", parentSpanID)
+			request.Header.Set("X-B3-Sampled", "1")
+		})
+
+		It("should continue the trace", func() {
+			Ω(upstreamHeader.Get("Traceparent")).Should(HavePrefix("00-" + traceID + "-"))
+			Ω(upstreamHeader.Get("Traceparent")).Should(HaveSuffix("-01"))
+			Ω(upstreamHeader.Get("X-B3-TraceId")).Should(Equal(traceID))
+			Ω(upstreamHeader.Get("X-B3-SpanId")).ShouldNot(Equal(parentSpanID))
+		})
+	})
+
+	Context("when the request has a query", func() {
+		BeforeEach(func() {
+			request.URL.RawQuery = "token=secret"
+			request.Header.Set("Traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+		})
+
+		It("should redact the query values of the exported URL", func() {
+			Eventually(exportedPayloads).Should(ContainSubstring(traceID))
+			Ω(exportedPayloads()).Should(ContainSubstring(`"key":"url.full","value":{"stringValue":"` + fakeServer.URL() + `/?token=[REDACTED]"}`))
+			Ω(exportedPayloads()).ShouldNot(ContainSubstring("secret"))
+		})
+	})
+
+	Context("when the request carries no trace context", func() {
+		It("should start a new trace", func() {
+			Ω(upstreamHeader.Get("Traceparent")).Should(MatchRegexp("^00-[0-9a-f]{32}-[0-9a-f]{16}-01$"))
+			Ω(upstreamHeader.Get("X-Aker-Request-Id")).Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("Tracing of closed handlers", func() {
+	It("should export the recorded spans", func() {
+		exported := make(chan string, 1)
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			exported <- string(body)
+		}))
+		defer collector.Close()
+		upstream := ghttp.NewServer()
+		defer upstream.Close()
+		upstream.AppendHandlers(ghttp.RespondWith(http.StatusOK, "content"))
+
+		handler, err := NewHandlerFromRawConfig([]byte("url: " + upstream.URL() + "\ntracing:\n  endpoint: " + collector.URL + "\n  service_name: closed-service\n  batch_timeout: 1h\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		Ω(exported).ShouldNot(Receive())
+
+		closer, ok := handler.(io.Closer)
+		Ω(ok).Should(BeTrue())
+		Ω(closer.Close()).Should(Succeed())
+		Eventually(exported).Should(Receive(ContainSubstring("closed-service")))
+	})
+})
+
+var _ = Describe("Tracing configuration", func() {
+	itShouldFail := func(config string) {
+		handler, err := NewHandlerFromRawConfig([]byte("url: http://localhost\ntracing:\n" + config))
+		Ω(err).Should(HaveOccurred())
+		Ω(handler).Should(BeNil())
+	}
+
+	It("should fail without endpoint", func() {
+		itShouldFail("  sample_ratio: 0.5\n")
+	})
+
+	It("should fail on invalid sample ratio", func() {
+		itShouldFail("  endpoint: http://localhost:4318/v1/traces\n  sample_ratio: 2\n")
+	})
+
+	It("should fail on unknown propagator", func() {
+		itShouldFail("  endpoint: http://localhost:4318/v1/traces\n  propagators: [jaeger]\n")
+	})
+})
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	unixSocketScheme     = "unix"
+	unixSocketHostSuffix = ".unix-socket"
+	unixSocketHostHeader = "localhost"
+)
+
+// upstreamTransport is the transport of upstream requests unless a
+// connection pool is configured. Unlike http.DefaultTransport, it dials
+// the hosts of unix socket URLs.
+var upstreamTransport = newUpstreamTransport()
+
+// unixSockets maps the hosts that stand for unix sockets to the paths of
+// the sockets.
+var unixSockets sync.Map
+
+func newUpstreamTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialUpstream(&net.Dialer{Timeout: defaultDialTimeout, KeepAlive: defaultKeepAliveInterval})
+	return transport
+}
+
+// resolveUnixSocketURL returns the HTTP URL of a unix socket URL such as
+// unix:///var/run/app.sock:/base/path, whose path consists of the socket
+// path and the optional base path of the upstream. The host of the
+// returned URL stands for the socket and is dialed by dialUpstream. Other
+// URLs are returned unchanged.
+func resolveUnixSocketURL(target *url.URL) *url.URL {
+	if target.Scheme != unixSocketScheme {
+		return target
+	}
+	socketPath, basePath := splitUnixSocketPath(target.Path)
+	hash := sha1.Sum([]byte(socketPath))
+	host := hex.EncodeToString(hash[:8]) + unixSocketHostSuffix
+	unixSockets.Store(host, socketPath)
+	return &url.URL{Scheme: "http", Host: host, Path: basePath, RawQuery: target.RawQuery}
+}
+
+func splitUnixSocketPath(p string) (socketPath, basePath string) {
+	if i := strings.Index(p, ":"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// unixSocketOf returns the socket path of a host returned by
+// resolveUnixSocketURL.
+func unixSocketOf(host string) (string, bool) {
+	if !strings.HasSuffix(host, unixSocketHostSuffix) {
+		return "", false
+	}
+	socketPath, ok := unixSockets.Load(host)
+	if !ok {
+		return "", false
+	}
+	return socketPath.(string), true
+}
+
+// upstreamHost returns the host sent in the Host header to target.
+func upstreamHost(target *url.URL) string {
+	if _, ok := unixSocketOf(target.Host); ok {
+		return unixSocketHostHeader
+	}
+	return target.Host
+}
+
+// dialUpstream returns a dial function that dials unix sockets for the
+// hosts that stand for them and uses dialer for all other addresses.
+func dialUpstream(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			if socketPath, ok := unixSocketOf(host); ok {
+				return dialer.DialContext(ctx, "unix", socketPath)
+			}
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
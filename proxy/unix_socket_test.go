@@ -0,0 +1,135 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	. "github.com/SAP/aker-proxy-plugin/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unix socket upstreams", func() {
+	var socketDir string
+	var requests chan *http.Request
+	var servers []*http.Server
+
+	serveSocket := func(name string) string {
+		socketPath := filepath.Join(socketDir, name)
+		listener, err := net.Listen("unix", socketPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			requests <- req
+			w.Header().Set("X-Socket", name)
+		})}
+		go server.Serve(listener)
+		servers = append(servers, server)
+		return socketPath
+	}
+
+	serve := func(handler http.Handler, target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+
+	BeforeEach(func() {
+		var err error
+		socketDir, err = ioutil.TempDir("", "upstream")
+		Ω(err).ShouldNot(HaveOccurred())
+		requests = make(chan *http.Request, 10)
+		servers = nil
+	})
+
+	AfterEach(func() {
+		for _, server := range servers {
+			server.Close()
+		}
+		os.RemoveAll(socketDir)
+	})
+
+	It("should proxy to the socket with the base path", func() {
+		socketPath := serveSocket("app.sock")
+		handler, err := NewHandlerFromRawConfig([]byte("url: unix://" + socketPath + ":/base\nproxy_path: /api\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(serve(handler, "http://example.com/api/path?q=1").Code).Should(Equal(http.StatusOK))
+		var req *http.Request
+		Ω(requests).Should(Receive(&req))
+		Ω(req.URL.Path).Should(Equal("/base/path"))
+		Ω(req.URL.RawQuery).Should(Equal("q=1"))
+		Ω(req.Host).Should(Equal("localhost"))
+	})
+
+	It("should proxy to the socket without base path", func() {
+		socketPath := serveSocket("app.sock")
+		handler, err := NewHandlerFromRawConfig([]byte("url: unix://" + socketPath + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(serve(handler, "/path").Code).Should(Equal(http.StatusOK))
+		var req *http.Request
+		Ω(requests).Should(Receive(&req))
+		Ω(req.URL.Path).Should(Equal("/path"))
+	})
+
+	It("should dial the socket from NewHandler", func() {
+		socketPath := serveSocket("app.sock")
+		targetURL, err := url.Parse("unix://" + socketPath + ":/base")
+		Ω(err).ShouldNot(HaveOccurred())
+		handler := NewHandler(targetURL, "", false, 0)
+
+		Ω(serve(handler, "/path").Code).Should(Equal(http.StatusOK))
+		var req *http.Request
+		Ω(requests).Should(Receive(&req))
+		Ω(req.URL.Path).Should(Equal("/base/path"))
+	})
+
+	It("should balance across socket targets", func() {
+		first := serveSocket("first.sock")
+		second := serveSocket("second.sock")
+		handler, err := NewHandlerFromRawConfig([]byte("targets:\n- unix://" + first + "\n- unix://" + second + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		sockets := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			recorder := serve(handler, "/path")
+			Ω(recorder.Code).Should(Equal(http.StatusOK))
+			sockets[recorder.Header().Get("X-Socket")] = true
+		}
+		Ω(sockets).Should(HaveLen(2))
+	})
+
+	It("should route to sockets through the connection pool", func() {
+		socketPath := serveSocket("app.sock")
+		handler, err := NewHandlerFromRawConfig([]byte("routes:\n- path: /api/*\n  url: unix://" + socketPath + ":/v1\n  proxy_path: /api\nconnection_pool:\n  max_conns_per_host: 4\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(serve(handler, "/api/path").Code).Should(Equal(http.StatusOK))
+		var req *http.Request
+		Ω(requests).Should(Receive(&req))
+		Ω(req.URL.Path).Should(Equal("/v1/path"))
+	})
+
+	It("should fail with bad gateway if the socket does not exist", func() {
+		handler, err := NewHandlerFromRawConfig([]byte("url: unix://" + filepath.Join(socketDir, "missing.sock") + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(serve(handler, "/path").Code).Should(Equal(http.StatusBadGateway))
+	})
+
+	It("should reject socket urls with host", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: unix://localhost/var/run/app.sock\n"))
+		Ω(err).Should(MatchError(ContainSubstring("url: host must be empty")))
+	})
+
+	It("should reject socket urls without socket path", func() {
+		_, err := NewHandlerFromRawConfig([]byte("url: unix://:/base\n"))
+		Ω(err).Should(HaveOccurred())
+	})
+})
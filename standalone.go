@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/SAP/aker-proxy-plugin/proxy"
+	"github.com/SAP/gologger"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// serveStandalone serves the handler of a configuration file on a TCP
+// address without Aker, until the process receives SIGTERM or SIGINT. It
+// returns the exit code of the process.
+func serveStandalone(args []string) int {
+	flags := flag.NewFlagSet("standalone", flag.ContinueOnError)
+	listen := flags.String("listen", ":8080", "TCP address to listen on")
+	configPath := flags.String("config", "", "path of the configuration file")
+	tlsCert := flags.String("tls-cert", "", "path of the TLS certificate, enables TLS with -tls-key")
+	tlsKey := flags.String("tls-key", "", "path of the TLS private key, enables TLS with -tls-cert")
+	shutdownTimeout := flags.Duration("shutdown-timeout", defaultShutdownTimeout, "time to wait for requests in flight on shutdown")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Standalone mode requires -config and no further arguments")
+		flags.Usage()
+		return 2
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintln(os.Stderr, "TLS requires both -tls-cert and -tls-key")
+		return 2
+	}
+
+	config, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		gologger.Errorf("Error reading configuration: %v", err)
+		return 1
+	}
+	handler, err := proxy.NewHandlerFromRawConfig(config)
+	if err != nil {
+		gologger.Errorf("Error creating handler: %v", err)
+		return 1
+	}
+
+	server := &http.Server{Addr: *listen, Handler: handler}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	errs := make(chan error, 1)
+	go func() {
+		if *tlsCert != "" {
+			errs <- server.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+	gologger.Infof("Listening on %s", *listen)
+
+	select {
+	case err := <-errs:
+		gologger.Errorf("Error serving HTTP: %v", err)
+		return 1
+	case sig := <-signals:
+		gologger.Infof("Shutting down due to: %v", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		gologger.Errorf("Error shutting down: %v", err)
+		return 1
+	}
+	if closer, ok := handler.(io.Closer); ok {
+		closer.Close()
+	}
+	return 0
+}